@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/configs"
+	"github.com/IT-Kungfu/service-discovery/pkg/etcdclient"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: sdctl [flags] <command> [args]
+
+Commands:
+  list                              list registered services
+  get <name> [instance]             show endpoints of a service
+  watch [name] [instance]           print registry changes
+  register [flags] <name> <instance> register a static endpoint
+  deregister <name> <instance> <id> remove an endpoint
+  gc [-dry-run]                     remove orphaned registry keys
+  maintenance <name> <instance> <id> [maintenance|draining|off]
+                                    take an endpoint out of rotation or return it
+  nodes                             list Docker nodes with a live agent
+  validate [name] [instance]        check service configs against their schemas
+  history <name> <instance>         list config snapshots
+  diff <name> <instance> <revision> [revision]
+                                    compare a config snapshot with another one
+                                    or with the current config
+  rollback <name> <instance> <revision>
+                                    restore a config snapshot
+
+Flags:
+`
+
+type ctl struct {
+	etcd    *clientv3.Client
+	client  *client.Client
+	output  string
+	timeout time.Duration
+}
+
+func main() {
+	c := &ctl{}
+	flag.StringVar(&c.output, "o", "table", "output format: table or json")
+	flag.DurationVar(&c.timeout, "timeout", 10*time.Second, "etcd request timeout")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	c.etcd, err = etcdclient.New()
+	if err != nil {
+		fatalf("etcd connection error: %v", err)
+	}
+	defer c.etcd.Close()
+	c.client = client.New(c.etcd, 0)
+
+	args := flag.Args()
+	switch args[0] {
+	case "list":
+		err = c.list()
+	case "get":
+		err = c.get(args[1:])
+	case "watch":
+		err = c.watch(args[1:])
+	case "register":
+		err = c.register(args[1:])
+	case "deregister":
+		err = c.deregister(args[1:])
+	case "gc":
+		err = c.gc(args[1:])
+	case "maintenance":
+		err = c.maintenance(args[1:])
+	case "nodes":
+		err = c.nodes()
+	case "validate":
+		err = c.validate(args[1:])
+	case "history":
+		err = c.history(args[1:])
+	case "diff":
+		err = c.diff(args[1:])
+	case "rollback":
+		err = c.rollback(args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fatalf("%s: %v", args[0], err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func (c *ctl) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+func (c *ctl) list() error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	services, err := c.client.List(ctx)
+	if err != nil {
+		return err
+	}
+	return c.printServices(services)
+}
+
+func (c *ctl) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("expected <name> [instance]")
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	services, err := c.client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	res := make([]*client.Service, 0)
+	for _, s := range services {
+		if s.Name == args[0] && (len(args) == 1 || s.Instance == args[1]) {
+			res = append(res, s)
+		}
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("service %s not found", strings.Join(args, "/"))
+	}
+	return c.printServices(res)
+}
+
+func (c *ctl) watch(args []string) error {
+	var name, instance string
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if len(args) > 1 {
+		instance = args[1]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	for ev := range c.client.Watch(ctx, name, instance) {
+		if ev.Err != nil {
+			fmt.Fprintf(os.Stderr, "watch error: %v\n", ev.Err)
+			continue
+		}
+		if err := c.printServices([]*client.Service{{Name: ev.Name, Instance: ev.Instance, Endpoints: ev.Endpoints}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ctl) register(args []string) error {
+	fs := flag.NewFlagSet("register", flag.ExitOnError)
+	id := fs.String("id", "", "endpoint id (defaults to host)")
+	host := fs.String("host", "", "internal host")
+	externalHost := fs.String("external-host", "", "external host")
+	port := fs.String("port", "", "internal gRPC port")
+	externalPort := fs.String("external-port", "", "external gRPC port")
+	meta := fs.String("meta", "", "metadata as comma separated key=value pairs")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 || *host == "" {
+		return fmt.Errorf("expected -host and <name> <instance>")
+	}
+
+	e := &registry.Endpoint{
+		ID:            *id,
+		Host:          *host,
+		ExternalHost:  *externalHost,
+		Ports:         make(map[string]string),
+		ExternalPorts: make(map[string]string),
+		Metadata:      map[string]string{"static": "true"},
+	}
+	if e.ID == "" {
+		e.ID = *host
+	}
+	if *port != "" {
+		e.Ports[registry.PortGrpc] = *port
+	}
+	if *externalPort != "" {
+		e.ExternalPorts[registry.PortGrpc] = *externalPort
+	}
+	if *meta != "" {
+		for _, pair := range strings.Split(*meta, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid metadata %q", pair)
+			}
+			e.Metadata[kv[0]] = kv[1]
+		}
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.Register(ctx, fs.Arg(0), fs.Arg(1), e)
+}
+
+func (c *ctl) deregister(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("expected <name> <instance> <id>")
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.Deregister(ctx, args[0], args[1], args[2])
+}
+
+func (c *ctl) gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the keys")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	keys, err := c.client.GC(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return json.NewEncoder(os.Stdout).Encode(keys)
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	return nil
+}
+
+func (c *ctl) maintenance(args []string) error {
+	if len(args) < 3 || len(args) > 4 {
+		return fmt.Errorf("expected <name> <instance> <id> [maintenance|draining|off]")
+	}
+	state := registry.StateMaintenance
+	if len(args) == 4 {
+		state = args[3]
+	}
+	if state == "off" {
+		state = ""
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+	return c.client.SetState(ctx, args[0], args[1], args[2], state)
+}
+
+func (c *ctl) nodes() error {
+	ctx, cancel := c.context()
+	defer cancel()
+
+	nodes, err := c.client.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(nodes)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tAGENT\tIPS\tDOCKER\tVERSION\tSTARTED")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			n.Name, dash(n.Agent), dash(strings.Join(n.IPs, ",")), dash(n.DockerVersion), dash(n.AgentVersion), n.Started.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) validate(args []string) error {
+	if len(args) > 2 {
+		return fmt.Errorf("expected [name] [instance]")
+	}
+	var name, instance string
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if len(args) > 1 {
+		instance = args[1]
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	violations, err := c.client.ValidateConfigs(ctx, name, instance)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(violations); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tINSTANCE\tKEY\tVIOLATION")
+		for _, v := range violations {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", v.Service, v.Instance, v.Key, v.Message)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d violations", len(violations))
+	}
+	return nil
+}
+
+func (c *ctl) history(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected <name> <instance>")
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	history, err := c.client.History(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(history)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tTIME\tKEYS\tCHANGES")
+	previous := map[string]string{}
+	for _, s := range history {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n",
+			s.Revision, s.Time.Format(time.RFC3339), len(s.Values), summarize(configs.Diff(previous, s.Values)))
+		previous = s.Values
+	}
+	return w.Flush()
+}
+
+func (c *ctl) diff(args []string) error {
+	if len(args) < 3 || len(args) > 4 {
+		return fmt.Errorf("expected <name> <instance> <revision> [revision]")
+	}
+	revisions, err := parseRevisions(args[2:])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	old, err := c.client.Version(ctx, args[0], args[1], revisions[0])
+	if err != nil {
+		return err
+	}
+	var current map[string]string
+	if len(revisions) == 2 {
+		s, err := c.client.Version(ctx, args[0], args[1], revisions[1])
+		if err != nil {
+			return err
+		}
+		current = s.Values
+	} else if current, err = c.client.Config(ctx, args[0], args[1]); err != nil {
+		return err
+	}
+	return c.printChanges(configs.Diff(old.Values, current))
+}
+
+func (c *ctl) rollback(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("expected <name> <instance> <revision>")
+	}
+	revisions, err := parseRevisions(args[2:])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.context()
+	defer cancel()
+
+	changes, err := c.client.Restore(ctx, args[0], args[1], revisions[0])
+	if err != nil {
+		return err
+	}
+	return c.printChanges(changes)
+}
+
+func (c *ctl) printChanges(changes []*configs.Change) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	for _, ch := range changes {
+		switch ch.Op {
+		case configs.ChangeAdded:
+			fmt.Printf("+ %s=%s\n", ch.Key, ch.New)
+		case configs.ChangeRemoved:
+			fmt.Printf("- %s=%s\n", ch.Key, ch.Old)
+		default:
+			fmt.Printf("~ %s=%s -> %s\n", ch.Key, ch.Old, ch.New)
+		}
+	}
+	return nil
+}
+
+func parseRevisions(args []string) ([]int64, error) {
+	res := make([]int64, 0, len(args))
+	for _, a := range args {
+		rev, err := strconv.ParseInt(a, 10, 64)
+		if err != nil || rev < 1 {
+			return nil, fmt.Errorf("invalid revision %q", a)
+		}
+		res = append(res, rev)
+	}
+	return res, nil
+}
+
+// summarize counts the added, updated and removed keys, e.g. "+2 ~1 -0".
+func summarize(changes []*configs.Change) string {
+	counts := map[string]int{}
+	for _, ch := range changes {
+		counts[ch.Op]++
+	}
+	return fmt.Sprintf("+%d ~%d -%d", counts[configs.ChangeAdded], counts[configs.ChangeUpdated], counts[configs.ChangeRemoved])
+}
+
+func (c *ctl) printServices(services []*client.Service) error {
+	if c.output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(services)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tINSTANCE\tID\tNODE\tHOST\tEXTERNAL\tPORTS\tSTATUS\tMETADATA")
+	for _, s := range services {
+		if len(s.Endpoints) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t-\t-\n", s.Name, s.Instance)
+		}
+		for _, e := range s.Endpoints {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.Name, s.Instance, dash(e.ID), dash(e.Node), dash(e.Host), dash(e.ExternalHost), formatMap(e.Ports), status(e), formatMap(e.Metadata))
+		}
+	}
+	return w.Flush()
+}
+
+func status(e *registry.Endpoint) string {
+	switch {
+	case e.State != "":
+		return e.State
+	case e.Health != "":
+		return e.Health
+	}
+	return "active"
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatMap(m map[string]string) string {
+	if len(m) == 0 {
+		return "-"
+	}
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
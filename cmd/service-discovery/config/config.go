@@ -1,8 +1,30 @@
 package config
 
 type Config struct {
-	InstanceName string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/instance_name" default:"dev"`
-	ETCDTimeout  int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/etcd_timeout" default:"10"`
-	LogLevel     string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/log_level,watcher" default:"debug"`
-	SentryDSN    string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/sentry_dsn,watcher" default:""`
+	InstanceName    string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/instance_name" default:"dev"`
+	ETCDTimeout     int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/etcd_timeout" default:"10"`
+	LogLevel        string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/log_level,watcher" default:"debug"`
+	SentryDSN       string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/sentry_dsn,watcher" default:""`
+	SkyDNSDomain    string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/skydns_domain" default:""`
+	SkyDNSPrefix    string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/skydns_prefix" default:"/skydns"`
+	TraefikPrefix   string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/traefik_prefix" default:""`
+	Templates       string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/templates" default:""`
+	TemplateWait    int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/template_wait" default:"500"`
+	AdminAddr       string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/admin_addr" default:"127.0.0.1:8080"`
+	Workers         int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/workers" default:"8"`
+	WorkerQueue     int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/worker_queue" default:"128"`
+	FlapTransitions int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/flap_transitions" default:"0"`
+	FlapWindow      int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/flap_window" default:"60"`
+	FlapStable      int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/flap_stable" default:"120"`
+	FlapPolicy      string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/flap_policy" default:"deregister"`
+	OutboxFile      string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/outbox_file" default:""`
+	ShutdownPolicy  string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/shutdown_policy" default:"keep"`
+	XDSAddr         string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/xds_addr" default:""`
+	DockerHosts     string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/docker_hosts" default:""`
+	ConflictPolicy  string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/conflict_policy" default:"takeover"`
+	NodeTTL         int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/node_ttl" default:"15"`
+	NodeGrace       int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/node_grace" default:"60"`
+	GCInterval      int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/gc_interval" default:"300"`
+	Instances       string `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/instances" default:""`
+	HistoryLimit    int    `etcd:"/configs/service-discovery/{{SERVICE_DISCOVERY_INSTANCE}}/history_limit" default:"50"`
 }
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/etcdclient"
+	"go.etcd.io/etcd/clientv3"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TagETCD            = "etcd"
+	TagDefault         = "default"
+	TagConnection      = "connection"
+	TagETCDWatcher     = "watcher"
+	EnvInstanceSuffix  = "_INSTANCE"
+	EnvExternalSuffix  = "_EXTERNAL"
+	ETCDExternalSuffix = "/external"
+)
+
+type Observer interface {
+	ETCDValueChanged(key string, value []byte, cfg interface{})
+}
+
+// ETCDConfig loads the config struct the same way etcdconfig does, reading the
+// etcd, default and connection tags, but connects with etcdclient so the TLS
+// variables apply to the config loading too.
+type ETCDConfig struct {
+	config    interface{}
+	mu        sync.Mutex
+	observers []Observer
+}
+
+func GetConfig(c interface{}) (*ETCDConfig, error) {
+	cli, err := etcdclient.New()
+	if err != nil {
+		return nil, fmt.Errorf("etcd connection error: %v", err)
+	}
+
+	cfg := &ETCDConfig{
+		config: c,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdclient.DefaultDialTimeout)
+	defer cancel()
+
+	ref := reflect.Indirect(reflect.ValueOf(c))
+	for i := 0; i < ref.Type().NumField(); i++ {
+		f := ref.Type().Field(i)
+
+		keyName, isWatch := parseTag(f.Tag.Get(TagETCD))
+		if keyName == "" {
+			continue
+		}
+		keyName = prepareKey(keyName, f.Tag.Get(TagConnection) == "true")
+
+		v, err := cli.Get(ctx, keyName)
+		if err != nil {
+			return nil, err
+		}
+
+		value, ok := f.Tag.Lookup(TagDefault)
+		if len(v.Kvs) > 0 {
+			value = string(v.Kvs[0].Value)
+		}
+		if !ok && value == "" {
+			return nil, fmt.Errorf("required configuration parameter is not specified - %s", keyName)
+		}
+		setField(ref.Field(i), value)
+
+		if isWatch {
+			go cfg.watch(cli, keyName, ref.Field(i))
+		}
+	}
+
+	return cfg, nil
+}
+
+func (cfg *ETCDConfig) AddObserver(o Observer) {
+	cfg.mu.Lock()
+	cfg.observers = append(cfg.observers, o)
+	cfg.mu.Unlock()
+}
+
+func (cfg *ETCDConfig) watch(cli *clientv3.Client, keyName string, field reflect.Value) {
+	for resp := range cli.Watch(context.Background(), keyName) {
+		for _, ev := range resp.Events {
+			setField(field, string(ev.Kv.Value))
+
+			cfg.mu.Lock()
+			observers := cfg.observers
+			cfg.mu.Unlock()
+			for _, o := range observers {
+				o.ETCDValueChanged(string(ev.Kv.Key), ev.Kv.Value, cfg.config)
+			}
+		}
+	}
+}
+
+func parseTag(tag string) (string, bool) {
+	params := strings.Split(tag, ",")
+	if len(params) == 2 {
+		return params[0], params[1] == TagETCDWatcher
+	}
+	return tag, false
+}
+
+// prepareKey replaces the {{ENV}} placeholders with environment variables.
+// For connection keys, a {{<SERVICE>_INSTANCE}} placeholder appends the
+// /external suffix when <SERVICE>_EXTERNAL is true, so the external address
+// of the service is read.
+func prepareKey(key string, isConnection bool) string {
+	for {
+		in := strings.Index(key, "{{")
+		out := strings.Index(key, "}}")
+		if in == -1 || out == -1 {
+			return key
+		}
+
+		env := key[in+2 : out]
+		key = strings.Replace(key, key[in:out+2], os.Getenv(env), -1)
+
+		if isConnection && strings.HasSuffix(env, EnvInstanceSuffix) {
+			serviceName := strings.TrimSuffix(env, EnvInstanceSuffix)
+			if os.Getenv(serviceName+EnvExternalSuffix) == "true" {
+				key += ETCDExternalSuffix
+			}
+		}
+	}
+}
+
+func setField(field reflect.Value, value string) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, _ := strconv.Atoi(value)
+		field.SetInt(int64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, _ := strconv.ParseUint(value, 10, 64)
+		field.SetUint(i)
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		field.SetBool(value == "true")
+	}
+}
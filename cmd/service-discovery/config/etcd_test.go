@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func setenv(t *testing.T, env map[string]string) {
+	for k, v := range env {
+		prev, ok := os.LookupEnv(k)
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+		k := k
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(k, prev)
+			} else {
+				os.Unsetenv(k)
+			}
+		})
+	}
+}
+
+func TestPrepareKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		key          string
+		isConnection bool
+		env          map[string]string
+		want         string
+	}{
+		{"no placeholders", "/configs/billing/dev/timeout", false, nil,
+			"/configs/billing/dev/timeout"},
+		{"placeholder", "/configs/billing/{{BILLING_INSTANCE}}/timeout", false,
+			map[string]string{"BILLING_INSTANCE": "dev"},
+			"/configs/billing/dev/timeout"},
+		{"several placeholders", "/configs/{{SERVICE}}/{{BILLING_INSTANCE}}/timeout", false,
+			map[string]string{"SERVICE": "billing", "BILLING_INSTANCE": "dev"},
+			"/configs/billing/dev/timeout"},
+		{"unclosed placeholder", "/configs/billing/{{BILLING_INSTANCE/timeout", false,
+			map[string]string{"BILLING_INSTANCE": "dev"},
+			"/configs/billing/{{BILLING_INSTANCE/timeout"},
+		{"internal connection", "/services/billing/{{BILLING_INSTANCE}}/host", true,
+			map[string]string{"BILLING_INSTANCE": "dev", "BILLING_EXTERNAL": "false"},
+			"/services/billing/dev/host"},
+		{"external connection", "/services/billing/{{BILLING_INSTANCE}}/host", true,
+			map[string]string{"BILLING_INSTANCE": "dev", "BILLING_EXTERNAL": "true"},
+			"/services/billing/dev/host/external"},
+		{"external setting of another service", "/services/billing/{{BILLING_INSTANCE}}/host", true,
+			map[string]string{"BILLING_INSTANCE": "dev", "AUTH_EXTERNAL": "true"},
+			"/services/billing/dev/host"},
+		{"external without the connection tag", "/services/billing/{{BILLING_INSTANCE}}/host", false,
+			map[string]string{"BILLING_INSTANCE": "dev", "BILLING_EXTERNAL": "true"},
+			"/services/billing/dev/host"},
+		{"connection without an instance placeholder", "/services/{{BILLING}}/dev/host", true,
+			map[string]string{"BILLING": "billing", "BILLING_EXTERNAL": "true"},
+			"/services/billing/dev/host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+			if got := prepareKey(tt.key, tt.isConnection); got != tt.want {
+				t.Fatalf("prepareKey(%q, %v) = %q, want %q", tt.key, tt.isConnection, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AdminShutdownTimeout = 5 * time.Second
+	ETCDHealthKey        = "health"
+)
+
+func (d *Discovery) startAdmin() error {
+	if d.cfg.AdminAddr == "" {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", d.cfg.AdminAddr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: d.adminHandler()}
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			d.log.Errorf("Admin server error: %v", err)
+		}
+	}()
+	go func() {
+		<-d.ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), AdminShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	d.log.Infof("Admin server listening on %s", d.cfg.AdminAddr)
+	return nil
+}
+
+func (d *Discovery) adminHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	mux.HandleFunc("/readyz", d.handleReadyz)
+	mux.HandleFunc("/v1/containers", d.handleContainers)
+	mux.HandleFunc("/v1/containers/", d.handleContainerState)
+	mux.HandleFunc("/v1/services", d.handleServices)
+	mux.HandleFunc("/v1/conflicts", d.handleConflicts)
+	mux.HandleFunc("/v1/nodes", d.handleNodes)
+	mux.HandleFunc("/v1/leader", d.handleLeader)
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+func (d *Discovery) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (d *Discovery) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"etcd": "ok",
+	}
+	status := http.StatusServiceUnavailable
+
+	// The agent is ready while any Docker node is connected, the state of
+	// each node is reported separately.
+	for _, n := range d.nodes {
+		checks["docker/"+n.Name] = "ok"
+		if n.isConnected() {
+			status = http.StatusOK
+		} else {
+			checks["docker/"+n.Name] = "event stream is not connected"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	if _, err := d.etcdClient.Get(ctx, ETCDHealthKey); err != nil {
+		checks["etcd"] = err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, checks)
+}
+
+func (d *Discovery) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.currentConflicts())
+}
+
+func (d *Discovery) handleLeader(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	leader, err := d.election.Leader(ctx)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+
+	tasks := make([]string, 0, len(d.leaderTasks))
+	for _, t := range d.leaderTasks {
+		tasks = append(tasks, t.name)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"leader": leader,
+		"agent":  d.agentName,
+		"self":   d.isLeader(),
+		"tasks":  tasks,
+	})
+}
+
+func (d *Discovery) handleNodes(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	nodes, err := client.New(d.etcdClient, 0).Nodes(ctx)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+func (d *Discovery) handleContainers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.trackedContainers())
+}
+
+// handleContainerState sets the state of a container with
+// PUT /v1/containers/<id>/state and a {"state": "maintenance"} body. An empty
+// state returns the container to service.
+func (d *Discovery) handleContainerState(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/containers/"), "/")
+	if len(parts) != 2 || parts[1] != "state" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var req struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.State != "" && req.State != registry.StateMaintenance && req.State != registry.StateDraining {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown state " + req.State})
+		return
+	}
+
+	var container *Container
+	for _, c := range d.trackedContainers() {
+		if c.ID == parts[0] || registry.ShortID(c.ID) == parts[0] {
+			container = c
+		}
+	}
+	if container == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "container not found"})
+		return
+	}
+
+	key := registry.MaintenanceKey(container.Name, container.Instance, registry.ShortID(container.ID))
+	var err error
+	if req.State == "" {
+		err = d.etcdDelete(key)
+	} else {
+		err = d.etcdPut(key, req.State)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": container.ID, "state": req.State})
+}
+
+func (d *Discovery) handleServices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.services())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
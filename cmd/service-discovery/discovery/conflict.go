@@ -0,0 +1,260 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"sort"
+	"time"
+)
+
+const (
+	ConflictTakeover   = "takeover"
+	ConflictRefuse     = "refuse"
+	ConflictMerge      = "merge"
+	OwnerClaimAttempts = 3
+)
+
+// Conflict is a registration whose host and ports keys were owned by a
+// container of another node.
+type Conflict struct {
+	Service        string    `json:"service"`
+	Instance       string    `json:"instance"`
+	Container      string    `json:"container"`
+	Node           string    `json:"node"`
+	OwnerNode      string    `json:"owner_node"`
+	OwnerContainer string    `json:"owner_container"`
+	Policy         string    `json:"policy"`
+	Time           time.Time `json:"time"`
+}
+
+func legacyKeys(name, instance string) []string {
+	return []string{
+		fmt.Sprintf(ETCDHostPattern, name, instance),
+		fmt.Sprintf(ETCDExternalHostPattern, name, instance),
+		fmt.Sprintf(ETCDPortsGrpcPattern, name, instance),
+		fmt.Sprintf(ETCDExternalPortsGrpcPattern, name, instance),
+	}
+}
+
+// readOwner returns the owner record of a service instance and its raw value
+// for compare-and-swap, nil and "" when there is none. It is also used while
+// deregistering on shutdown, after the agent context is cancelled, so it does
+// not derive from it.
+func (d *Discovery) readOwner(name, instance string) (*registry.Owner, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Get(ctx, fmt.Sprintf(registry.OwnerPattern, name, instance))
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, "", err
+	}
+	owner, err := registry.ParseOwner(resp.Kvs[0].Value)
+	return owner, string(resp.Kvs[0].Value), err
+}
+
+// claimOwner writes the owner record of a registration. When the host and
+// ports keys are owned by another node the conflict policy applies: takeover
+// overwrites them, merge registers the container only as a replica without
+// touching them and refuse skips the registration, reported by a false
+// result. The record is written only if it did not change since it was read,
+// so of two agents registering at the same time the second one sees the
+// conflict. The owner key is returned to be tracked with the container; when
+// etcd is unreachable the record is added to kv instead and retried with it.
+func (d *Discovery) claimOwner(id, node, name, instance string, kv map[string]string) (string, bool) {
+	key := fmt.Sprintf(registry.OwnerPattern, name, instance)
+	value, err := (&registry.Owner{Node: node, Container: registry.ShortID(id)}).Marshal()
+	if err != nil {
+		d.log.Errorf("Owner record error: %v", err)
+		return "", true
+	}
+
+	for attempt := 0; attempt < OwnerClaimAttempts; attempt++ {
+		owner, current, err := d.readOwner(name, instance)
+		if err != nil {
+			d.log.Errorf("Owner record of %s/%s read error: %v", name, instance, err)
+			kv[key] = value
+			return "", true
+		}
+
+		if owner != nil && owner.Node != node {
+			policy := d.conflict(id, node, name, instance, owner)
+			switch policy {
+			case ConflictRefuse:
+				return "", false
+			case ConflictMerge:
+				for _, k := range legacyKeys(name, instance) {
+					delete(kv, k)
+				}
+				return "", true
+			}
+		} else {
+			d.clearConflict(id)
+		}
+
+		cmp := clientv3.Compare(clientv3.Value(key), "=", current)
+		if owner == nil {
+			cmp = clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+		resp, err := d.etcdClient.Txn(ctx).If(cmp).Then(clientv3.OpPut(key, value)).Commit()
+		cancel()
+		if err != nil {
+			metricETCDErrors.WithLabelValues("put").Inc()
+			d.log.Errorf("Owner record of %s/%s write error: %v", name, instance, err)
+			kv[key] = value
+			return "", true
+		}
+		if resp.Succeeded {
+			return key, true
+		}
+	}
+
+	d.log.Warnf("Owner record of %s/%s keeps changing, taking it over", name, instance)
+	kv[key] = value
+	return "", true
+}
+
+// conflict records a registration of a service instance owned by another
+// node and returns the policy to apply.
+func (d *Discovery) conflict(id, node, name, instance string, owner *registry.Owner) string {
+	policy := d.cfg.ConflictPolicy
+	if policy != ConflictRefuse && policy != ConflictMerge {
+		policy = ConflictTakeover
+	}
+	d.log.Warnf("%s/%s is owned by %s on %s, %s of %s on %s",
+		name, instance, owner.Container, owner.Node, policy, registry.ShortID(id), node)
+	metricConflicts.WithLabelValues(name, instance, policy).Inc()
+	d.mu.Lock()
+	d.conflicts[id] = &Conflict{
+		Service:        name,
+		Instance:       instance,
+		Container:      registry.ShortID(id),
+		Node:           node,
+		OwnerNode:      owner.Node,
+		OwnerContainer: owner.Container,
+		Policy:         policy,
+		Time:           time.Now(),
+	}
+	d.mu.Unlock()
+	return policy
+}
+
+// releasableKeys drops the host and ports keys and the owner record from the
+// keys of a stopped container when another container took them over. When
+// the owner record cannot be read they are kept, as they may belong to
+// another node. When the container owns them they are handed over to another
+// replica, which may have been registered by its agent only as a replica
+// under the merge policy, or removed with the container when there is none.
+func (d *Discovery) releasableKeys(id, name, instance string, keys []string) []string {
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, name, instance)
+	owned := map[string]bool{ownerKey: true}
+	for _, k := range legacyKeys(name, instance) {
+		owned[k] = true
+	}
+
+	owner, current, err := d.readOwner(name, instance)
+	switch {
+	case err != nil:
+		d.log.Errorf("Owner record of %s/%s read error, keeping its keys: %v", name, instance, err)
+	case owner == nil:
+		return keys
+	case owner.Container == registry.ShortID(id) && !d.handOver(id, name, instance, current):
+		// Keys handed over to this container by a previous owner are not
+		// among its own.
+		res := append([]string(nil), keys...)
+		for _, k := range append(legacyKeys(name, instance), ownerKey) {
+			if !containsKey(keys, k) {
+				res = append(res, k)
+			}
+		}
+		return res
+	}
+
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !owned[k] {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// handOver writes the host and ports keys and the owner record of another
+// routable replica of the service in place of those of the container, if it
+// still owns them. It reports whether they were handed over.
+func (d *Discovery) handOver(id, name, instance, current string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Get(ctx, fmt.Sprintf(registry.EndpointsPattern, name, instance), clientv3.WithPrefix())
+	if err != nil {
+		d.log.Errorf("Endpoints of %s/%s read error: %v", name, instance, err)
+		return false
+	}
+
+	for _, v := range resp.Kvs {
+		e, err := registry.ParseEndpoint(v.Value)
+		if err != nil || e.ID == registry.ShortID(id) || e.Host == "" || !e.Routable() {
+			continue
+		}
+		owner, err := (&registry.Owner{Node: e.Node, Container: e.ID}).Marshal()
+		if err != nil {
+			d.log.Errorf("Owner record error: %v", err)
+			return false
+		}
+
+		ownerKey := fmt.Sprintf(registry.OwnerPattern, name, instance)
+		values := []string{e.Host, e.ExternalHost, e.Ports[registry.PortGrpc], e.ExternalPorts[registry.PortGrpc]}
+		ops := []clientv3.Op{clientv3.OpPut(ownerKey, owner)}
+		for i, k := range legacyKeys(name, instance) {
+			if values[i] != "" {
+				ops = append(ops, clientv3.OpPut(k, values[i]))
+			} else {
+				ops = append(ops, clientv3.OpDelete(k))
+			}
+		}
+		resp, err := d.etcdClient.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(ownerKey), "=", current)).
+			Then(ops...).
+			Commit()
+		if err != nil {
+			metricETCDErrors.WithLabelValues("put").Inc()
+			d.log.Errorf("Owner record of %s/%s write error: %v", name, instance, err)
+			return false
+		}
+		if resp.Succeeded {
+			d.log.Infof("%s/%s handed over from %s to %s on %s", name, instance, registry.ShortID(id), e.ID, e.Node)
+		}
+		return resp.Succeeded
+	}
+	return false
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Discovery) clearConflict(id string) {
+	d.mu.Lock()
+	delete(d.conflicts, id)
+	d.mu.Unlock()
+}
+
+func (d *Discovery) currentConflicts() []*Conflict {
+	d.mu.RLock()
+	res := make([]*Conflict, 0, len(d.conflicts))
+	for _, c := range d.conflicts {
+		res = append(res, c)
+	}
+	d.mu.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Time.Before(res[j].Time)
+	})
+	return res
+}
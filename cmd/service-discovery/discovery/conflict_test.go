@@ -0,0 +1,183 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testOwner(t *testing.T, node, container string) string {
+	value, err := (&registry.Owner{Node: node, Container: container}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestClaimOwner(t *testing.T) {
+	const id = "aaaaaaaaaaaa"
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, "billing", "dev")
+	hostKey := fmt.Sprintf(ETCDHostPattern, "billing", "dev")
+	portKey := fmt.Sprintf(ETCDPortsGrpcPattern, "billing", "dev")
+	own := testOwner(t, "node-a", id)
+	other := testOwner(t, "node-b", "bbbbbbbbbbbb")
+
+	tests := []struct {
+		name     string
+		policy   string
+		owner    string
+		ok       bool
+		keys     []string
+		want     string
+		conflict bool
+	}{
+		{"no owner", ConflictTakeover, "", true, []string{hostKey, portKey}, own, false},
+		{"owned by this node", ConflictRefuse, testOwner(t, "node-a", "bbbbbbbbbbbb"), true, []string{hostKey, portKey}, own, false},
+		{"takeover", ConflictTakeover, other, true, []string{hostKey, portKey}, own, true},
+		{"unknown policy takes over", "", other, true, []string{hostKey, portKey}, own, true},
+		{"refuse", ConflictRefuse, other, false, []string{hostKey, portKey}, other, true},
+		{"merge", ConflictMerge, other, true, []string{}, other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, kv := newTestDiscovery(t, &config.Config{ConflictPolicy: tt.policy})
+			if tt.owner != "" {
+				if _, err := d.etcdClient.Put(d.ctx, ownerKey, tt.owner); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			keys := map[string]string{hostKey: "10.0.0.1", portKey: "9000"}
+			claimed, ok := d.claimOwner(id, "node-a", "billing", "dev", keys)
+			if ok != tt.ok {
+				t.Fatalf("claimOwner() = %v, want %v", ok, tt.ok)
+			}
+			if want := tt.want == own; (claimed == ownerKey) != want {
+				t.Fatalf("claimOwner() key = %q, want claimed %v", claimed, want)
+			}
+			if got := sortedKeys(keys); !reflect.DeepEqual(got, tt.keys) {
+				t.Fatalf("keys = %v, want %v", got, tt.keys)
+			}
+			if got, _ := kv.value(ownerKey); got != tt.want {
+				t.Fatalf("owner record = %s, want %s", got, tt.want)
+			}
+			if _, ok := d.conflicts[id]; ok != tt.conflict {
+				t.Fatalf("conflict recorded = %v, want %v", ok, tt.conflict)
+			}
+		})
+	}
+}
+
+func TestClaimOwnerUnreachable(t *testing.T) {
+	d, kv := newTestDiscovery(t, &config.Config{})
+	kv.setErr(errors.New("etcd unavailable"))
+
+	// The owner record is written with the other keys once etcd is back.
+	keys := map[string]string{}
+	claimed, ok := d.claimOwner("aaaaaaaaaaaa", "node-a", "billing", "dev", keys)
+	if claimed != "" || !ok {
+		t.Fatalf("claimOwner() = %q, %v, want \"\", true", claimed, ok)
+	}
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, "billing", "dev")
+	if keys[ownerKey] != testOwner(t, "node-a", "aaaaaaaaaaaa") {
+		t.Fatalf("keys = %v, want the owner record", keys)
+	}
+}
+
+func sortedKeys(kv map[string]string) []string {
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestReleasableKeys(t *testing.T) {
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, "billing", "dev")
+	hostKey := fmt.Sprintf(ETCDHostPattern, "billing", "dev")
+	endpointKey := registry.EndpointKey("billing", "dev", "aaaaaaaaaaaa")
+	keys := []string{hostKey, ownerKey, endpointKey}
+	owned := append(append([]string(nil), keys...), legacyKeys("billing", "dev")[1:]...)
+
+	tests := []struct {
+		name  string
+		owner string
+		want  []string
+	}{
+		{"no owner", "", keys},
+		{"owned by the container", testOwner(t, "node-a", "aaaaaaaaaaaa"), owned},
+		{"taken over", testOwner(t, "node-b", "bbbbbbbbbbbb"), []string{endpointKey}},
+		{"unreadable owner", "{", []string{endpointKey}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDiscovery(t, &config.Config{})
+			if tt.owner != "" {
+				if _, err := d.etcdClient.Put(d.ctx, ownerKey, tt.owner); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := d.releasableKeys("aaaaaaaaaaaa", "billing", "dev", keys); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("releasableKeys() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleasableKeysHandOver(t *testing.T) {
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, "billing", "dev")
+	hostKey := fmt.Sprintf(ETCDHostPattern, "billing", "dev")
+	portKey := fmt.Sprintf(ETCDPortsGrpcPattern, "billing", "dev")
+	externalHostKey := fmt.Sprintf(ETCDExternalHostPattern, "billing", "dev")
+	endpointKey := registry.EndpointKey("billing", "dev", "aaaaaaaaaaaa")
+
+	d, kv := newTestDiscovery(t, &config.Config{ConflictPolicy: ConflictMerge})
+	replicas := []*registry.Endpoint{
+		{ID: "aaaaaaaaaaaa", Node: "node-a", Host: "10.0.0.1", Ports: map[string]string{registry.PortGrpc: "9000"}},
+		{ID: "bbbbbbbbbbbb", Node: "node-b", Host: "10.0.0.2", State: registry.StateDraining},
+		{ID: "cccccccccccc", Node: "node-c", Host: "10.0.0.3", Ports: map[string]string{registry.PortGrpc: "9001"}},
+	}
+	for _, e := range replicas {
+		value, err := e.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.etcdClient.Put(d.ctx, registry.EndpointKey("billing", "dev", e.ID), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, v := range map[string]string{
+		ownerKey:        testOwner(t, "node-a", "aaaaaaaaaaaa"),
+		hostKey:         "10.0.0.1",
+		externalHostKey: "1.2.3.4",
+		portKey:         "9000",
+	} {
+		if _, err := d.etcdClient.Put(d.ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := []string{hostKey, portKey, ownerKey, endpointKey}
+	if got := d.releasableKeys("aaaaaaaaaaaa", "billing", "dev", keys); !reflect.DeepEqual(got, []string{endpointKey}) {
+		t.Fatalf("releasableKeys() = %v, want %v", got, []string{endpointKey})
+	}
+
+	want := map[string]string{
+		ownerKey: testOwner(t, "node-c", "cccccccccccc"),
+		hostKey:  "10.0.0.3",
+		portKey:  "9001",
+	}
+	for k, v := range want {
+		if got, _ := kv.value(k); got != v {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if _, ok := kv.value(externalHostKey); ok {
+		t.Fatalf("%s kept, want it removed", externalHostKey)
+	}
+}
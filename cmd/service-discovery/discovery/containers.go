@@ -0,0 +1,173 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"sort"
+)
+
+type Container struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Instance      string            `json:"instance"`
+	Node          string            `json:"node"`
+	Host          string            `json:"host"`
+	ExternalHost  string            `json:"external_host,omitempty"`
+	Ports         map[string]string `json:"ports,omitempty"`
+	ExternalPorts map[string]string `json:"external_ports,omitempty"`
+	Labels        map[string]string `json:"-"`
+	Keys          []string          `json:"keys"`
+	Health        string            `json:"health,omitempty"`
+	State         string            `json:"state,omitempty"`
+	endpoint      *registry.Endpoint
+	kv            map[string]string
+	published     map[string]string
+}
+
+type Service struct {
+	Name      string       `json:"name"`
+	Instance  string       `json:"instance"`
+	Endpoints []*Container `json:"endpoints"`
+}
+
+func (d *Discovery) track(c *Container) {
+	d.mu.Lock()
+	d.containers[c.ID] = c
+	d.mu.Unlock()
+	d.updateEndpointMetrics(c.Name, c.Instance)
+	d.registryChanged()
+}
+
+func (d *Discovery) untrack(id string) *Container {
+	d.mu.Lock()
+	c, ok := d.containers[id]
+	if ok {
+		delete(d.containers, id)
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	d.updateEndpointMetrics(c.Name, c.Instance)
+	d.registryChanged()
+	return c
+}
+
+// updateContainer replaces the tracked container with an updated copy, so
+// containers handed out by the views are never modified. It returns the
+// previous and the updated container, or nil when nothing changed.
+func (d *Discovery) updateContainer(id string, update func(c *Container) bool) (*Container, *Container) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.containers[id]
+	if !ok {
+		return nil, nil
+	}
+	updated := *c
+	if !update(&updated) {
+		return c, nil
+	}
+	d.containers[id] = &updated
+	return c, &updated
+}
+
+// routable reports whether the container should receive traffic.
+func (c *Container) routable() bool {
+	return c.Health != registry.HealthCritical && c.State == ""
+}
+
+func (d *Discovery) putEndpoint(c *Container) {
+	e := *c.endpoint
+	e.Health = c.Health
+	e.State = c.State
+	value, err := e.Marshal()
+	if err != nil {
+		d.log.Errorf("Endpoint record error: %v", err)
+		return
+	}
+	d.putKeys(c.ID, map[string]string{registry.EndpointKey(c.Name, c.Instance, e.ID): value})
+}
+
+func (d *Discovery) subscribe() <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	d.mu.Lock()
+	d.subscribers = append(d.subscribers, ch)
+	d.mu.Unlock()
+	return ch
+}
+
+func (d *Discovery) registryChanged() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, ch := range d.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (d *Discovery) isTracked(id string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.containers[id]
+	return ok
+}
+
+func (d *Discovery) trackedContainers() []*Container {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	res := make([]*Container, 0, len(d.containers))
+	for _, c := range d.containers {
+		res = append(res, c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+func (d *Discovery) replicas(serviceName, serviceInstance string) []*Container {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	res := make([]*Container, 0)
+	for _, c := range d.containers {
+		if c.Name == serviceName && c.Instance == serviceInstance {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+func (d *Discovery) services() []*Service {
+	d.mu.RLock()
+	byName := make(map[string]*Service)
+	for _, c := range d.containers {
+		key := c.Name + "/" + c.Instance
+		s, ok := byName[key]
+		if !ok {
+			s = &Service{Name: c.Name, Instance: c.Instance}
+			byName[key] = s
+		}
+		s.Endpoints = append(s.Endpoints, c)
+	}
+	d.mu.RUnlock()
+
+	res := make([]*Service, 0, len(byName))
+	for _, s := range byName {
+		sort.Slice(s.Endpoints, func(i, j int) bool {
+			return s.Endpoints[i].ID < s.Endpoints[j].ID
+		})
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].Instance < res[j].Instance
+	})
+	return res
+}
@@ -5,11 +5,18 @@ import (
 	"fmt"
 	"github.com/IT-Kungfu/logger"
 	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/IT-Kungfu/service-discovery/pkg/election"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"go.etcd.io/etcd/clientv3"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -18,26 +25,63 @@ const (
 	LabelServiceInstance         = "discovery.service.instance"
 	LabelServicePortsGrpc        = "discovery.service.ports.grpc"
 	LabelServiceHostExternal     = "discovery.service.host.external"
-	ETCDHostPattern              = "/services/%s/%s/host"
-	ETCDExternalHostPattern      = "/services/%s/%s/host/external"
-	ETCDPortsGrpcPattern         = "/services/%s/%s/ports/grpc"
-	ETCDExternalPortsGrpcPattern = "/services/%s/%s/ports/grpc/external"
+	LabelServiceMetaPrefix       = "discovery.service.meta."
+	ETCDHostPattern              = registry.HostPattern
+	ETCDExternalHostPattern      = registry.ExternalHostPattern
+	ETCDPortsGrpcPattern         = registry.PortsGrpcPattern
+	ETCDExternalPortsGrpcPattern = registry.ExternalPortsGrpcPattern
+	DockerReconnectDelay         = 5 * time.Second
 )
 
 type Discovery struct {
-	cfg          *config.Config
-	log          *logger.Logger
-	dockerClient *client.Client
-	etcdClient   *clientv3.Client
-	ctx          context.Context
-	ctxCancel    context.CancelFunc
+	cfg            *config.Config
+	log            *logger.Logger
+	etcdClient     *clientv3.Client
+	ctx            context.Context
+	ctxCancel      context.CancelFunc
+	mu             sync.RWMutex
+	containers     map[string]*Container
+	subscribers    []chan struct{}
+	templates      []*configTemplate
+	xdsCache       cache.SnapshotCache
+	checks         map[string]context.CancelFunc
+	outbox         *outbox
+	queues         []chan events.Message
+	workers        sync.WaitGroup
+	traefikMu      sync.Mutex
+	traefikKeys    map[string][]string
+	flapMu         sync.Mutex
+	flaps          map[string]*flapState
+	nodes          []*dockerNode
+	containerNodes map[string]*dockerNode
+	policy         *registrationPolicy
+	conflicts      map[string]*Conflict
+	denied         map[string]bool
+	rotations      map[string]*rotationRetry
+	agentName      string
+	started        time.Time
+	nodeLease      clientv3.LeaseID
+	election       *election.Election
+	leaderTasks    []*leaderTask
+	leaderDone     chan struct{}
+	leading        int32
 }
 
 func New(ctx context.Context) (*Discovery, error) {
 	services := ctx.Value("services").(map[string]interface{})
 	d := &Discovery{
-		cfg: services["cfg"].(*config.Config),
-		log: services["log"].(*logger.Logger),
+		cfg:            services["cfg"].(*config.Config),
+		log:            services["log"].(*logger.Logger),
+		containers:     make(map[string]*Container),
+		traefikKeys:    make(map[string][]string),
+		checks:         make(map[string]context.CancelFunc),
+		flaps:          make(map[string]*flapState),
+		containerNodes: make(map[string]*dockerNode),
+		conflicts:      make(map[string]*Conflict),
+		denied:         make(map[string]bool),
+		rotations:      make(map[string]*rotationRetry),
+		started:        time.Now(),
+		leaderDone:     make(chan struct{}),
 	}
 
 	d.ctx, d.ctxCancel = context.WithCancel(context.Background())
@@ -46,7 +90,48 @@ func New(ctx context.Context) (*Discovery, error) {
 		return nil, err
 	}
 
+	var err error
+	if d.outbox, err = newOutbox(d.cfg.OutboxFile); err != nil {
+		return nil, err
+	}
+
+	if err := d.initDockerNodes(); err != nil {
+		return nil, err
+	}
+	if d.agentName, err = os.Hostname(); err != nil {
+		d.agentName = d.cfg.InstanceName
+	}
+	d.election = election.New(d.etcdClient, registry.LeaderPrefix, int64(d.nodeTTL()))
+	d.initLeaderTasks()
+
+	policyRev, err := d.loadPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.initTemplates(); err != nil {
+		return nil, err
+	}
+
+	if err := d.startXDS(); err != nil {
+		return nil, err
+	}
+
+	if err := d.startAdmin(); err != nil {
+		return nil, err
+	}
+
+	d.startWorkers()
 	go d.start()
+	go d.renderTemplates()
+	if len(d.templates) > 0 || d.xdsCache != nil {
+		go d.watchRegistry()
+	}
+	go d.watchMaintenance()
+	go d.watchPolicy(policyRev)
+	go d.keepNodes()
+	go d.runLeader()
+	go d.retryOutbox()
 
 	return d, nil
 }
@@ -54,37 +139,154 @@ func New(ctx context.Context) (*Discovery, error) {
 func (d *Discovery) start() {
 	d.log.Info("Service discovery started")
 
-	var err error
-	d.dockerClient, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		panic(err)
+	for _, n := range d.nodes {
+		go d.watchNode(n)
 	}
+}
 
-	msgCh, errCh := d.dockerClient.Events(d.ctx, types.EventsOptions{})
+func (d *Discovery) watchNode(n *dockerNode) {
+	for {
+		d.listen(n)
 
-	var isBreak bool
-	for !isBreak {
 		select {
 		case <-d.ctx.Done():
-			isBreak = true
+			return
+		case <-time.After(DockerReconnectDelay):
+			d.log.Infof("Reconnecting to Docker events of %s", n.Name)
+			metricStreamReconnects.WithLabelValues(n.Name).Inc()
+		}
+	}
+}
+
+func (d *Discovery) listen(n *dockerNode) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	msgCh, errCh := n.client.Events(ctx, types.EventsOptions{})
+	if err := d.registerRunning(n); err != nil {
+		d.log.Errorf("Container list error on %s: %v", n.Name, err)
+		return
+	}
+
+	d.nodeConnected(n)
+	atomic.StoreInt32(&n.connected, 1)
+	metricDockerConnected.WithLabelValues(n.Name).Set(1)
+	defer func() {
+		atomic.StoreInt32(&n.connected, 0)
+		metricDockerConnected.WithLabelValues(n.Name).Set(0)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
 		case err := <-errCh:
 			if err != nil {
-				d.log.Errorf("Event error: %v", err)
+				d.log.Errorf("Event error on %s: %v", n.Name, err)
 			}
+			return
 		case msg := <-msgCh:
-			if msg.Status != "" {
-				if msg.Status == "start" || msg.Status == "unpause" {
-					d.serviceStart(msg)
-				} else if msg.Status == "die" || msg.Status == "pause" {
-					d.serviceStop(msg)
-				}
+			if msg.Status == "" {
+				continue
+			}
+			metricDockerEvents.WithLabelValues(msg.Type, eventAction(msg)).Inc()
+			// Image, network and volume events do not concern registrations
+			// and their IDs are not containers.
+			if msg.Type != events.ContainerEventType {
+				continue
+			}
+			d.setContainerNode(msg.ID, n)
+			d.dispatch(msg)
+		}
+	}
+}
+
+// eventAction returns the action of an event without its arguments, such as
+// the command of exec_start or the status of health_status, so it can be
+// used as a metric label.
+func eventAction(msg events.Message) string {
+	action := msg.Action
+	if action == "" {
+		action = msg.Status
+	}
+	return strings.SplitN(action, ":", 2)[0]
+}
+
+// registerRunning registers the running containers of the node and
+// deregisters its tracked containers that stopped while the event stream was
+// down. Endpoint records of the node in etcd are read before the containers
+// are listed, so a record without a running container belongs to a container
+// that stopped or was removed while the agent was down, and is removed.
+func (d *Discovery) registerRunning(n *dockerNode) error {
+	records, err := d.nodeEndpoints(n)
+	if err != nil {
+		return err
+	}
+
+	containers, err := n.client.ContainerList(d.ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelServiceName)),
+	})
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		if c.State == "running" {
+			running[c.ID] = true
+			running[registry.ShortID(c.ID)] = true
+			if !d.isTracked(c.ID) && n.isReconciled() {
+				metricReconcileCorrections.Inc()
 			}
+			d.setContainerNode(c.ID, n)
+			d.dispatch(reconcileEvent(c.ID, "start"))
+		}
+	}
+
+	tracked := make(map[string]bool)
+	for _, c := range d.trackedContainers() {
+		tracked[registry.ShortID(c.ID)] = true
+		if c.Node == n.Name && !running[c.ID] {
+			metricReconcileCorrections.Inc()
+			d.dispatch(reconcileEvent(c.ID, "die"))
 		}
 	}
+	for _, r := range records {
+		if !running[r.endpoint.ID] && !tracked[r.endpoint.ID] {
+			metricReconcileCorrections.Inc()
+			d.removeEndpoint(n, r)
+		}
+	}
+	atomic.StoreInt32(&n.reconciled, 1)
+
+	// Queued writes of containers not seen on any node are dropped once every
+	// node has listed its containers.
+	reconciled := true
+	for _, node := range d.nodes {
+		reconciled = reconciled && node.isReconciled()
+	}
+	d.outbox.prune(func(id string) bool {
+		node := d.containerNode(id)
+		return (node == n && !running[id]) || (node == nil && reconciled)
+	})
+	return nil
+}
+
+func (d *Discovery) inspect(id string) (types.ContainerJSON, error) {
+	n := d.containerNode(id)
+	if n == nil {
+		return types.ContainerJSON{}, fmt.Errorf("no Docker node known for container %s", id)
+	}
+
+	start := time.Now()
+	defer func() {
+		metricInspectDuration.Observe(time.Since(start).Seconds())
+	}()
+	return n.client.ContainerInspect(d.ctx, id)
 }
 
 func (d *Discovery) serviceStart(msg events.Message) {
-	inspect, err := d.dockerClient.ContainerInspect(d.ctx, msg.ID)
+	inspect, err := d.inspect(msg.ID)
 	if err != nil {
 		d.log.Errorf("Inspect error: %v", err)
 		return
@@ -112,13 +314,32 @@ func (d *Discovery) serviceStart(msg events.Message) {
 
 	serviceName := inspect.Config.Labels[LabelServiceName]
 	serviceInstance := inspect.Config.Labels[LabelServiceInstance]
+	if !d.checkPolicy(serviceName, serviceInstance, inspect) {
+		return
+	}
+	d.seedConfig(inspect, serviceName, serviceInstance)
+
 	containerIP := inspect.NetworkSettings.Networks[inspect.Config.Labels[LabelServiceNetwork]].IPAddress
 	containerPorts := inspect.NetworkSettings.Ports
+	published := make(map[string]string)
+	for k, v := range containerPorts {
+		if k.Proto() == "tcp" && len(v) > 0 && v[0].HostPort != "" {
+			published[k.Port()] = v[0].HostPort
+		}
+	}
+
+	nodeName, externalHost := "", inspect.Config.Labels[LabelServiceHostExternal]
+	if n := d.containerNode(inspect.ID); n != nil {
+		nodeName = n.Name
+		if externalHost == "" {
+			externalHost = n.ExternalIP
+		}
+	}
 
 	etcdKv := make(map[string]string, 4)
 	etcdKv[fmt.Sprintf(ETCDHostPattern, serviceName, serviceInstance)] = containerIP
-	if inspect.Config.Labels[LabelServiceHostExternal] != "" {
-		etcdKv[fmt.Sprintf(ETCDExternalHostPattern, serviceName, serviceInstance)] = inspect.Config.Labels[LabelServiceHostExternal]
+	if externalHost != "" {
+		etcdKv[fmt.Sprintf(ETCDExternalHostPattern, serviceName, serviceInstance)] = externalHost
 	}
 
 	if _, ok := inspect.Config.Labels[LabelServicePortsGrpc]; ok {
@@ -130,21 +351,103 @@ func (d *Discovery) serviceStart(msg events.Message) {
 						ports = append(ports, p.HostPort)
 					}
 				}
+				etcdKv[fmt.Sprintf(ETCDPortsGrpcPattern, serviceName, serviceInstance)] = k.Port()
 				etcdKv[fmt.Sprintf(ETCDExternalPortsGrpcPattern, serviceName, serviceInstance)] = strings.Join(ports, ",")
 			}
-			etcdKv[fmt.Sprintf(ETCDPortsGrpcPattern, serviceName, serviceInstance)] = k.Port()
 		}
 	}
 
-	for k, v := range etcdKv {
-		if err := d.etcdPut(k, v); err != nil {
-			d.log.Errorf("Error writing to ETCD: %v", err)
+	if d.cfg.SkyDNSDomain != "" {
+		record, err := d.skyDNSValue(inspect, containerIP)
+		if err != nil {
+			d.log.Errorf("SkyDNS record error: %v", err)
+		} else {
+			etcdKv[d.skyDNSKey(serviceName, serviceInstance, inspect.ID)] = record
+		}
+	}
+
+	ports := make(map[string]string)
+	externalPorts := make(map[string]string)
+	if v, ok := etcdKv[fmt.Sprintf(ETCDPortsGrpcPattern, serviceName, serviceInstance)]; ok {
+		ports[registry.PortGrpc] = v
+	}
+	if v, ok := etcdKv[fmt.Sprintf(ETCDExternalPortsGrpcPattern, serviceName, serviceInstance)]; ok {
+		externalPorts[registry.PortGrpc] = v
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range inspect.Config.Labels {
+		if strings.HasPrefix(k, LabelServiceMetaPrefix) {
+			metadata[strings.TrimPrefix(k, LabelServiceMetaPrefix)] = v
 		}
 	}
+
+	endpointRecord := &registry.Endpoint{
+		ID:            registry.ShortID(inspect.ID),
+		Node:          nodeName,
+		Host:          containerIP,
+		ExternalHost:  externalHost,
+		Ports:         ports,
+		ExternalPorts: externalPorts,
+		Metadata:      metadata,
+	}
+	endpoint, err := endpointRecord.Marshal()
+	if err != nil {
+		d.log.Errorf("Endpoint record error: %v", err)
+	} else {
+		etcdKv[registry.EndpointKey(serviceName, serviceInstance, registry.ShortID(inspect.ID))] = endpoint
+	}
+
+	ownerKey, ok := d.claimOwner(inspect.ID, nodeName, serviceName, serviceInstance, etcdKv)
+	if !ok {
+		return
+	}
+
+	keys := make([]string, 0, len(etcdKv)+1)
+	for k := range etcdKv {
+		keys = append(keys, k)
+	}
+	if ownerKey != "" {
+		keys = append(keys, ownerKey)
+	}
+	d.putKeys(inspect.ID, etcdKv)
+
+	metricRegistrations.WithLabelValues(serviceName, serviceInstance).Inc()
+	c := &Container{
+		ID:            inspect.ID,
+		Name:          serviceName,
+		Instance:      serviceInstance,
+		Node:          nodeName,
+		Host:          containerIP,
+		ExternalHost:  externalHost,
+		Ports:         ports,
+		ExternalPorts: externalPorts,
+		Labels:        inspect.Config.Labels,
+		Keys:          keys,
+		endpoint:      endpointRecord,
+		kv:            etcdKv,
+		published:     published,
+	}
+	d.track(c)
+	if state := d.maintenanceState(c); state != "" {
+		d.setState(c.ID, state)
+	}
+	d.startHealthCheck(c)
+	d.traefikSync(serviceName, serviceInstance)
 }
 
 func (d *Discovery) serviceStop(msg events.Message) {
-	inspect, err := d.dockerClient.ContainerInspect(d.ctx, msg.ID)
+	d.stopHealthCheck(msg.ID)
+	d.clearConflict(msg.ID)
+	if c := d.untrack(msg.ID); c != nil {
+		d.log.Infof("%s stoped", c.Name)
+		metricDeregistrations.WithLabelValues(c.Name, c.Instance).Inc()
+		d.deleteKeys(c.ID, d.releasableKeys(c.ID, c.Name, c.Instance, c.Keys))
+		d.traefikSync(c.Name, c.Instance)
+		return
+	}
+
+	inspect, err := d.inspect(msg.ID)
 	if err != nil {
 		d.log.Errorf("Inspect error: %v", err)
 		return
@@ -162,20 +465,28 @@ func (d *Discovery) serviceStop(msg events.Message) {
 
 	serviceName := inspect.Config.Labels[LabelServiceName]
 	serviceInstance := inspect.Config.Labels[LabelServiceInstance]
-	keys := []string{
-		fmt.Sprintf(ETCDHostPattern, serviceName, serviceInstance),
-		fmt.Sprintf(ETCDExternalHostPattern, serviceName, serviceInstance),
-		fmt.Sprintf(ETCDPortsGrpcPattern, serviceName, serviceInstance),
-		fmt.Sprintf(ETCDExternalPortsGrpcPattern, serviceName, serviceInstance),
+	keys := append(legacyKeys(serviceName, serviceInstance),
+		fmt.Sprintf(registry.OwnerPattern, serviceName, serviceInstance),
+		registry.EndpointKey(serviceName, serviceInstance, registry.ShortID(inspect.ID)))
+	if d.cfg.SkyDNSDomain != "" {
+		keys = append(keys, d.skyDNSKey(serviceName, serviceInstance, inspect.ID))
 	}
 
-	for _, k := range keys {
-		if err := d.etcdDelete(k); err != nil {
-			d.log.Errorf("Error deleting from ETCD: %v", err)
-		}
-	}
+	metricDeregistrations.WithLabelValues(serviceName, serviceInstance).Inc()
+	d.deleteKeys(inspect.ID, d.releasableKeys(inspect.ID, serviceName, serviceInstance, keys))
+	d.traefikSync(serviceName, serviceInstance)
 }
 
+// Stop cancels the agent and waits for the workers to finish the events in
+// hand before the shutdown policy is applied, so a container registered
+// meanwhile is not left out of it.
 func (d *Discovery) Stop() {
 	d.ctxCancel()
+	d.workers.Wait()
+	d.shutdown()
+
+	select {
+	case <-d.leaderDone:
+	case <-time.After(LeaderResignTimeout):
+	}
 }
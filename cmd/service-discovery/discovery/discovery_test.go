@@ -0,0 +1,389 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IT-Kungfu/logger"
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"go.etcd.io/etcd/clientv3"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeKV is an in-memory clientv3.KV. It records every applied mutation so
+// tests can check the order in which keys were written, and fails every
+// request while err is set, like an unreachable cluster.
+type fakeKV struct {
+	mu      sync.Mutex
+	rev     int64
+	data    map[string]*mvccpb.KeyValue
+	ops     map[string][]string
+	err     error
+	putHook func(key string)
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{
+		data: make(map[string]*mvccpb.KeyValue),
+		ops:  make(map[string][]string),
+	}
+}
+
+func (kv *fakeKV) setErr(err error) {
+	kv.mu.Lock()
+	kv.err = err
+	kv.mu.Unlock()
+}
+
+// setPutHook installs a function called before every Put, outside the lock,
+// so a test can hold a write in flight.
+func (kv *fakeKV) setPutHook(hook func(key string)) {
+	kv.mu.Lock()
+	kv.putHook = hook
+	kv.mu.Unlock()
+}
+
+func (kv *fakeKV) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: kv.rev}
+}
+
+func (kv *fakeKV) keys(key, end []byte) []string {
+	if len(end) == 0 {
+		if _, ok := kv.data[string(key)]; ok {
+			return []string{string(key)}
+		}
+		return nil
+	}
+
+	keys := make([]string, 0)
+	for k := range kv.data {
+		if k >= string(key) && (string(end) == "\x00" || k < string(end)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (kv *fakeKV) put(key, value []byte) {
+	kv.rev++
+	k := string(key)
+	if prev, ok := kv.data[k]; ok {
+		kv.data[k] = &mvccpb.KeyValue{Key: key, Value: value, CreateRevision: prev.CreateRevision, ModRevision: kv.rev, Version: prev.Version + 1}
+	} else {
+		kv.data[k] = &mvccpb.KeyValue{Key: key, Value: value, CreateRevision: kv.rev, ModRevision: kv.rev, Version: 1}
+	}
+	kv.ops[k] = append(kv.ops[k], "put")
+}
+
+func (kv *fakeKV) delete(key, end []byte) int64 {
+	keys := kv.keys(key, end)
+	if len(keys) == 0 {
+		return 0
+	}
+	kv.rev++
+	for _, k := range keys {
+		delete(kv.data, k)
+		kv.ops[k] = append(kv.ops[k], "delete")
+	}
+	return int64(len(keys))
+}
+
+func (kv *fakeKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	kv.mu.Lock()
+	hook := kv.putHook
+	kv.mu.Unlock()
+	if hook != nil {
+		hook(key)
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.err != nil {
+		return nil, kv.err
+	}
+	kv.put([]byte(key), []byte(val))
+	return &clientv3.PutResponse{Header: kv.header()}, nil
+}
+
+func (kv *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(key, opts...)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.err != nil {
+		return nil, kv.err
+	}
+	resp := &clientv3.GetResponse{Header: kv.header()}
+	for _, k := range kv.keys(op.KeyBytes(), op.RangeBytes()) {
+		v := *kv.data[k]
+		if op.IsKeysOnly() {
+			v.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &v)
+	}
+	resp.Count = int64(len(resp.Kvs))
+	return resp, nil
+}
+
+func (kv *fakeKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	op := clientv3.OpDelete(key, opts...)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.err != nil {
+		return nil, kv.err
+	}
+	deleted := kv.delete(op.KeyBytes(), op.RangeBytes())
+	return &clientv3.DeleteResponse{Header: kv.header(), Deleted: deleted}, nil
+}
+
+func (kv *fakeKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return nil, errors.New("fakeKV: compact is not supported")
+}
+
+func (kv *fakeKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	return clientv3.OpResponse{}, errors.New("fakeKV: do is not supported")
+}
+
+func (kv *fakeKV) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxn{kv: kv}
+}
+
+// value returns the value stored under key.
+func (kv *fakeKV) value(key string) (string, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	v, ok := kv.data[key]
+	if !ok {
+		return "", false
+	}
+	return string(v.Value), true
+}
+
+// snapshot returns the stored keys and values.
+func (kv *fakeKV) snapshot() map[string]string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	res := make(map[string]string, len(kv.data))
+	for k, v := range kv.data {
+		res[k] = string(v.Value)
+	}
+	return res
+}
+
+// history returns the mutations applied to key, oldest first.
+func (kv *fakeKV) history(key string) []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return append([]string(nil), kv.ops[key]...)
+}
+
+type fakeTxn struct {
+	kv    *fakeKV
+	cmps  []clientv3.Cmp
+	thenO []clientv3.Op
+	elseO []clientv3.Op
+}
+
+func (t *fakeTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *fakeTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenO = append(t.thenO, ops...)
+	return t
+}
+
+func (t *fakeTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseO = append(t.elseO, ops...)
+	return t
+}
+
+func (t *fakeTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.kv.mu.Lock()
+	defer t.kv.mu.Unlock()
+	if t.kv.err != nil {
+		return nil, t.kv.err
+	}
+
+	succeeded := true
+	for i := range t.cmps {
+		if !t.compare(&t.cmps[i]) {
+			succeeded = false
+			break
+		}
+	}
+	ops := t.elseO
+	if succeeded {
+		ops = t.thenO
+	}
+	for _, op := range ops {
+		switch {
+		case op.IsPut():
+			t.kv.put(op.KeyBytes(), op.ValueBytes())
+		case op.IsDelete():
+			t.kv.delete(op.KeyBytes(), op.RangeBytes())
+		default:
+			return nil, errors.New("fakeKV: only put and delete are supported in a txn")
+		}
+	}
+	return &clientv3.TxnResponse{Header: t.kv.header(), Succeeded: succeeded}, nil
+}
+
+func (t *fakeTxn) compare(cmp *clientv3.Cmp) bool {
+	keys := t.kv.keys(cmp.KeyBytes(), cmp.RangeEnd)
+	if len(keys) == 0 {
+		return t.compareKV(cmp, &mvccpb.KeyValue{Key: cmp.KeyBytes()})
+	}
+	for _, k := range keys {
+		if !t.compareKV(cmp, t.kv.data[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *fakeTxn) compareKV(cmp *clientv3.Cmp, v *mvccpb.KeyValue) bool {
+	var r int
+	switch u := cmp.TargetUnion.(type) {
+	case *pb.Compare_Value:
+		r = bytes.Compare(v.Value, u.Value)
+	case *pb.Compare_CreateRevision:
+		r = compareInt(v.CreateRevision, u.CreateRevision)
+	case *pb.Compare_ModRevision:
+		r = compareInt(v.ModRevision, u.ModRevision)
+	case *pb.Compare_Version:
+		r = compareInt(v.Version, u.Version)
+	default:
+		return false
+	}
+
+	switch cmp.Result {
+	case pb.Compare_EQUAL:
+		return r == 0
+	case pb.Compare_NOT_EQUAL:
+		return r != 0
+	case pb.Compare_GREATER:
+		return r > 0
+	case pb.Compare_LESS:
+		return r < 0
+	}
+	return false
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// newTestDiscovery returns an agent writing to an in-memory etcd. Docker is
+// not connected; tests track containers directly.
+func newTestDiscovery(tb testing.TB, cfg *config.Config) (*Discovery, *fakeKV) {
+	log, err := logger.New(&logger.Config{LogLevel: "error"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if cfg.ETCDTimeout == 0 {
+		cfg.ETCDTimeout = 5
+	}
+
+	kv := newFakeKV()
+	d := &Discovery{
+		cfg:            cfg,
+		log:            log,
+		etcdClient:     &clientv3.Client{KV: kv},
+		containers:     make(map[string]*Container),
+		traefikKeys:    make(map[string][]string),
+		checks:         make(map[string]context.CancelFunc),
+		flaps:          make(map[string]*flapState),
+		containerNodes: make(map[string]*dockerNode),
+		conflicts:      make(map[string]*Conflict),
+		denied:         make(map[string]bool),
+		rotations:      make(map[string]*rotationRetry),
+	}
+	d.ctx, d.ctxCancel = context.WithCancel(context.Background())
+	tb.Cleanup(d.ctxCancel)
+	if d.outbox, err = newOutbox(""); err != nil {
+		tb.Fatal(err)
+	}
+	return d, kv
+}
+
+func TestServiceStartGrpcPort(t *testing.T) {
+	const id = "aaaaaaaaaaaa0000000000000000000000000000000000000000000000000000"
+	ports := nat.PortMap{}
+	for p := 8000; p < 8016; p++ {
+		ports[nat.Port(fmt.Sprintf("%d/tcp", p))] = []nat.PortBinding{{HostPort: fmt.Sprintf("%d", p+10000)}}
+	}
+	inspect := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    id,
+			State: &types.ContainerState{Status: "running", Running: true},
+		},
+		Config: &container.Config{
+			Labels: map[string]string{
+				LabelServiceName:      "billing",
+				LabelServiceInstance:  "dev",
+				LabelServiceNetwork:   "backend",
+				LabelServicePortsGrpc: "8007",
+			},
+		},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{Ports: ports},
+			Networks: map[string]*network.EndpointSettings{
+				"backend": {IPAddress: "10.0.0.1"},
+			},
+		},
+	}
+
+	d, kv := newTestDiscovery(t, &config.Config{})
+	n := newTestNode(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(inspect)
+	}))
+	d.nodes = []*dockerNode{n}
+	d.setContainerNode(id, n)
+
+	d.serviceStart(events.Message{ID: id, Status: "start"})
+	for k, want := range map[string]string{
+		fmt.Sprintf(ETCDPortsGrpcPattern, "billing", "dev"):         "8007",
+		fmt.Sprintf(ETCDExternalPortsGrpcPattern, "billing", "dev"): "18007",
+	} {
+		if got, _ := kv.value(k); got != want {
+			t.Fatalf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestEventAction(t *testing.T) {
+	tests := []struct {
+		msg  events.Message
+		want string
+	}{
+		{events.Message{Status: "start", Action: "start"}, "start"},
+		{events.Message{Status: "exec_start: sh -c date", Action: "exec_start: sh -c date"}, "exec_start"},
+		{events.Message{Status: "health_status: unhealthy", Action: "health_status: unhealthy"}, "health_status"},
+		{events.Message{Status: "die"}, "die"},
+	}
+	for _, tt := range tests {
+		if got := eventAction(tt.msg); got != tt.want {
+			t.Errorf("eventAction(%q) = %q, want %q", tt.msg.Action, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/docker/docker/client"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// dockerNode is one Docker daemon watched by the agent. Every node has its
+// own client and event stream, so a failing daemon does not stop the others.
+type dockerNode struct {
+	Name          string `json:"name"`
+	Host          string `json:"host,omitempty"`
+	ExternalIP    string `json:"external_ip,omitempty"`
+	tlsPath       string
+	client        *client.Client
+	ips           []string
+	dockerVersion string
+	connected     int32
+	reconciled    int32
+}
+
+func (n *dockerNode) isConnected() bool {
+	return atomic.LoadInt32(&n.connected) == 1
+}
+
+func (n *dockerNode) isReconciled() bool {
+	return atomic.LoadInt32(&n.reconciled) == 1
+}
+
+// initDockerNodes parses the docker_hosts setting: a semicolon separated list
+// of name=<node>,host=tcp://<addr>[,tls=<dir>][,ip=<external ip>] entries. The
+// tls directory holds ca.pem, cert.pem and key.pem as in DOCKER_CERT_PATH.
+// Without the setting the local daemon from the DOCKER_* variables is
+// watched under the hostname.
+func (d *Discovery) initDockerNodes() error {
+	for _, entry := range strings.Split(d.cfg.DockerHosts, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		n := &dockerNode{}
+		for _, pair := range strings.Split(entry, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid docker host definition %q", entry)
+			}
+			switch kv[0] {
+			case "name":
+				n.Name = kv[1]
+			case "host":
+				n.Host = kv[1]
+			case "tls":
+				n.tlsPath = kv[1]
+			case "ip":
+				n.ExternalIP = kv[1]
+			default:
+				return fmt.Errorf("unknown docker host option %q in %q", kv[0], entry)
+			}
+		}
+		if n.Name == "" || n.Host == "" {
+			return fmt.Errorf("docker host %q needs a name and a host", entry)
+		}
+		if d.node(n.Name) != nil {
+			return fmt.Errorf("duplicate docker host name %s", n.Name)
+		}
+		d.nodes = append(d.nodes, n)
+	}
+
+	if len(d.nodes) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		d.nodes = append(d.nodes, &dockerNode{Name: hostname})
+	}
+
+	for _, n := range d.nodes {
+		n.ips = nodeIPs(n)
+		opts := []client.Opt{client.FromEnv}
+		if n.Host != "" {
+			opts = []client.Opt{client.WithHost(n.Host)}
+		}
+		opts = append(opts, client.WithAPIVersionNegotiation())
+		if n.tlsPath != "" {
+			opts = append(opts, client.WithTLSClientConfig(
+				filepath.Join(n.tlsPath, "ca.pem"),
+				filepath.Join(n.tlsPath, "cert.pem"),
+				filepath.Join(n.tlsPath, "key.pem"),
+			))
+		}
+		var err error
+		if n.client, err = client.NewClientWithOpts(opts...); err != nil {
+			return fmt.Errorf("docker host %s: %v", n.Name, err)
+		}
+	}
+	return nil
+}
+
+func (d *Discovery) node(name string) *dockerNode {
+	for _, n := range d.nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// containerNode returns the node a container was last seen on. Container IDs
+// are unique across daemons.
+func (d *Discovery) containerNode(id string) *dockerNode {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.containerNodes[id]
+}
+
+func (d *Discovery) setContainerNode(id string, n *dockerNode) {
+	d.mu.Lock()
+	d.containerNodes[id] = n
+	d.mu.Unlock()
+}
+
+func (d *Discovery) forgetContainerNode(id string) {
+	d.mu.Lock()
+	delete(d.containerNodes, id)
+	d.mu.Unlock()
+}
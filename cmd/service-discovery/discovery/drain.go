@@ -0,0 +1,97 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types/events"
+	"time"
+)
+
+const (
+	LabelServiceDrainDelay = "discovery.service.drain.delay"
+	ShutdownKeep           = "keep"
+	ShutdownDeregister     = "deregister"
+	ShutdownDrain          = "drain"
+)
+
+// drainSignals are the kill signals that stop a container, as opposed to
+// signals used for reloads.
+var drainSignals = map[string]bool{
+	"2":  true,
+	"3":  true,
+	"9":  true,
+	"15": true,
+}
+
+// serviceDrain takes the container out of rotation as soon as it is asked to
+// stop. The records are removed after the drain delay or on die, whichever
+// comes first.
+func (d *Discovery) serviceDrain(msg events.Message) {
+	c := d.setState(msg.ID, registry.StateDraining)
+	if c == nil {
+		return
+	}
+	metricDrains.WithLabelValues(c.Name, c.Instance).Inc()
+
+	delay := time.Duration(labelInt(c.Labels, LabelServiceDrainDelay, 0)) * time.Second
+	if delay <= 0 {
+		d.serviceStop(msg)
+		return
+	}
+
+	d.log.Infof("%s draining for %s", c.Name, delay)
+	time.AfterFunc(delay, func() {
+		d.dispatch(events.Message{ID: msg.ID, Status: StatusDrained})
+	})
+}
+
+func (d *Discovery) drainExpired(id string) {
+	d.mu.RLock()
+	c, ok := d.containers[id]
+	d.mu.RUnlock()
+	if !ok || c.State != registry.StateDraining {
+		return
+	}
+	d.serviceStop(events.Message{ID: id})
+}
+
+func (d *Discovery) setState(id, state string) *Container {
+	c, updated := d.updateContainer(id, func(c *Container) bool {
+		if c.State == state {
+			return false
+		}
+		c.State = state
+		return true
+	})
+	if updated == nil {
+		return nil
+	}
+
+	if state == "" {
+		d.log.Infof("%s %s is back in service", c.Name, registry.ShortID(c.ID))
+	} else {
+		d.log.Infof("%s %s is %s", c.Name, registry.ShortID(c.ID), state)
+	}
+	d.putEndpoint(updated)
+	if c.routable() != updated.routable() {
+		d.syncRotation(updated)
+	}
+	d.traefikSync(c.Name, c.Instance)
+	d.registryChanged()
+	return updated
+}
+
+// shutdown applies the shutdown policy to the tracked containers.
+func (d *Discovery) shutdown() {
+	switch d.cfg.ShutdownPolicy {
+	case ShutdownDeregister:
+		d.log.Info("Deregistering all containers")
+		for _, c := range d.trackedContainers() {
+			d.serviceStop(events.Message{ID: c.ID})
+		}
+	case ShutdownDrain:
+		d.log.Info("Draining all containers")
+		for _, c := range d.trackedContainers() {
+			d.setState(c.ID, registry.StateDraining)
+		}
+	}
+}
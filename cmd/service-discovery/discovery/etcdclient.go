@@ -2,45 +2,36 @@ package discovery
 
 import (
 	"context"
-	"go.etcd.io/etcd/clientv3"
-	"os"
-	"strings"
+	"github.com/IT-Kungfu/service-discovery/pkg/etcdclient"
 	"time"
 )
 
-const (
-	DefaultETCDAddr = "localhost:2379"
-)
-
 func (d *Discovery) initEtcdClient() error {
-	etcdAddr := os.Getenv("ETCD_ADDR")
-	if len(etcdAddr) == 0 {
-		etcdAddr = DefaultETCDAddr
-	}
-
-	etcdConfig := clientv3.Config{
-		Endpoints:   strings.Split(etcdAddr, ","),
-		DialTimeout: 10 * time.Second,
-	}
-
-	if os.Getenv("ETCD_USERNAME") != "" && os.Getenv("ETCD_PASSWORD") != "" {
-		etcdConfig.Username = os.Getenv("ETCD_USERNAME")
-		etcdConfig.Password = os.Getenv("ETCD_PASSWORD")
-	}
-
 	var err error
-	d.etcdClient, err = clientv3.New(etcdConfig)
+	d.etcdClient, err = etcdclient.New()
 	return err
 }
 
 func (d *Discovery) etcdPut(key, value string) error {
-	ctx, _ := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	start := time.Now()
 	_, err := d.etcdClient.Put(ctx, key, value)
+	metricETCDDuration.WithLabelValues("put").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricETCDErrors.WithLabelValues("put").Inc()
+	}
 	return err
 }
 
 func (d *Discovery) etcdDelete(key string) error {
-	ctx, _ := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	start := time.Now()
 	_, err := d.etcdClient.Delete(ctx, key)
+	metricETCDDuration.WithLabelValues("delete").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricETCDErrors.WithLabelValues("delete").Inc()
+	}
 	return err
 }
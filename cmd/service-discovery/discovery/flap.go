@@ -0,0 +1,159 @@
+package discovery
+
+import (
+	"github.com/docker/docker/api/types/events"
+	"time"
+)
+
+const (
+	FlapPolicyDeregister = "deregister"
+	FlapPolicyHold       = "hold"
+	StatusFlapStable     = "flap-stable"
+	AttrReconcile        = "discovery.reconcile"
+)
+
+type flapState struct {
+	transitions []time.Time
+	damped      bool
+	running     bool
+	seen        bool
+	last        time.Time
+	timer       *time.Timer
+}
+
+// reconcileEvent marks the events sent while reconciling with the container
+// list, which are not state changes and must not count as transitions.
+func reconcileEvent(id, status string) events.Message {
+	return events.Message{
+		ID:     id,
+		Status: status,
+		Actor:  events.Actor{ID: id, Attributes: map[string]string{AttrReconcile: "true"}},
+	}
+}
+
+// damp records a start/die transition of the container and reports whether
+// the event must be suppressed. After flap_transitions transitions within
+// flap_window the container is held, deregistered or in its last state,
+// until it has not changed for flap_stable seconds. Reconcile events and
+// repeated events of the same state are not transitions.
+func (d *Discovery) damp(msg events.Message) bool {
+	if d.cfg.FlapTransitions <= 0 {
+		return false
+	}
+
+	switch msg.Status {
+	case "start", "unpause", "die", "pause", "kill", "stop":
+	case "destroy":
+		d.flapMu.Lock()
+		if f, ok := d.flaps[msg.ID]; ok && f.timer != nil {
+			f.timer.Stop()
+		}
+		delete(d.flaps, msg.ID)
+		d.flapMu.Unlock()
+		return false
+	default:
+		return false
+	}
+
+	now := time.Now()
+	window := time.Duration(d.cfg.FlapWindow) * time.Second
+	stable := time.Duration(d.cfg.FlapStable) * time.Second
+
+	d.flapMu.Lock()
+	suppress, deregister := d.recordTransition(msg, now, window, stable)
+	d.flapMu.Unlock()
+
+	if deregister {
+		d.serviceStop(events.Message{ID: msg.ID})
+	}
+	if suppress {
+		metricFlapSuppressed.Inc()
+		d.log.Debugf("Suppressed %s of flapping container %s", msg.Status, msg.ID)
+	}
+	return suppress
+}
+
+func (d *Discovery) recordTransition(msg events.Message, now time.Time, window, stable time.Duration) (bool, bool) {
+	f, ok := d.flaps[msg.ID]
+	if !ok {
+		f = &flapState{}
+		d.flaps[msg.ID] = f
+	}
+
+	if msg.Status == "kill" || msg.Status == "stop" {
+		return f.damped, false
+	}
+
+	// Reconcile events only tell the current state.
+	running := msg.Status == "start" || msg.Status == "unpause"
+	changed := f.seen && f.running != running
+	f.running, f.seen = running, true
+	if !changed || msg.Actor.Attributes[AttrReconcile] == "true" {
+		return f.damped, false
+	}
+
+	transitions := f.transitions[:0]
+	for _, t := range f.transitions {
+		if now.Sub(t) < window {
+			transitions = append(transitions, t)
+		}
+	}
+	f.transitions = append(transitions, now)
+	f.last = now
+
+	if !f.damped && len(f.transitions) < d.cfg.FlapTransitions {
+		return false, false
+	}
+
+	id := msg.ID
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.timer = time.AfterFunc(stable, func() {
+		d.dispatch(events.Message{ID: id, Status: StatusFlapStable})
+	})
+
+	deregister := false
+	if !f.damped {
+		f.damped = true
+		d.log.Warnf("Container %s is flapping, %d transitions in %s", id, len(f.transitions), window)
+		metricFlapping.Inc()
+		deregister = d.cfg.FlapPolicy == FlapPolicyDeregister
+	}
+
+	return true, deregister
+}
+
+// isDamped reports whether the container is held for flapping.
+func (d *Discovery) isDamped(id string) bool {
+	d.flapMu.Lock()
+	defer d.flapMu.Unlock()
+	f, ok := d.flaps[id]
+	return ok && f.damped
+}
+
+// flapStable releases a damped container that has not changed for the stable
+// period and registers or deregisters it according to its current state.
+func (d *Discovery) flapStable(id string) {
+	stable := time.Duration(d.cfg.FlapStable) * time.Second
+
+	d.flapMu.Lock()
+	f, ok := d.flaps[id]
+	if !ok || !f.damped || time.Since(f.last) < stable {
+		d.flapMu.Unlock()
+		return
+	}
+	f.damped = false
+	f.transitions = nil
+	f.timer = nil
+	d.flapMu.Unlock()
+
+	d.log.Infof("Container %s is stable again", id)
+
+	inspect, err := d.inspect(id)
+	if err != nil || inspect.State == nil || !inspect.State.Running || inspect.State.Paused {
+		d.serviceStop(events.Message{ID: id})
+		return
+	}
+	d.serviceStart(events.Message{ID: id})
+}
@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/docker/docker/api/types/events"
+	"testing"
+	"time"
+)
+
+func TestRecordTransition(t *testing.T) {
+	type event struct {
+		status     string
+		at         time.Duration
+		suppress   bool
+		deregister bool
+	}
+	tests := []struct {
+		name   string
+		policy string
+		events []event
+	}{
+		{"below threshold", FlapPolicyDeregister, []event{
+			{"start", 0, false, false},
+			{"die", time.Second, false, false},
+			{"start", 2 * time.Second, false, false},
+		}},
+		{"damped at threshold", FlapPolicyDeregister, []event{
+			{"start", 0, false, false},
+			{"die", time.Second, false, false},
+			{"start", 2 * time.Second, false, false},
+			{"die", 3 * time.Second, true, true},
+			{"start", 4 * time.Second, true, false},
+		}},
+		{"hold policy keeps the registration", FlapPolicyHold, []event{
+			{"start", 0, false, false},
+			{"die", time.Second, false, false},
+			{"start", 2 * time.Second, false, false},
+			{"die", 3 * time.Second, true, false},
+		}},
+		{"transitions leave the window", FlapPolicyDeregister, []event{
+			{"start", 0, false, false},
+			{"die", 30 * time.Second, false, false},
+			{"start", 90 * time.Second, false, false},
+			{"die", 100 * time.Second, false, false},
+		}},
+		{"repeated events are not transitions", FlapPolicyDeregister, []event{
+			{"start", 0, false, false},
+			{"die", time.Second, false, false},
+			{"die", 2 * time.Second, false, false},
+			{"die", 3 * time.Second, false, false},
+		}},
+		{"stop signals are not transitions", FlapPolicyDeregister, []event{
+			{"start", 0, false, false},
+			{"kill", time.Second, false, false},
+			{"stop", time.Second, false, false},
+			{"die", 2 * time.Second, false, false},
+			{"start", 3 * time.Second, false, false},
+		}},
+		{"stop signals of a damped container are suppressed", FlapPolicyDeregister, []event{
+			{"start", 0, false, false},
+			{"die", time.Second, false, false},
+			{"start", 2 * time.Second, false, false},
+			{"die", 3 * time.Second, true, true},
+			{"kill", 4 * time.Second, true, false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDiscovery(t, &config.Config{
+				FlapTransitions: 3,
+				FlapWindow:      60,
+				FlapStable:      120,
+				FlapPolicy:      tt.policy,
+			})
+			window := time.Duration(d.cfg.FlapWindow) * time.Second
+			stable := time.Duration(d.cfg.FlapStable) * time.Second
+			start := time.Now()
+			for i, e := range tt.events {
+				suppress, deregister := d.recordTransition(events.Message{ID: "a", Status: e.status}, start.Add(e.at), window, stable)
+				if suppress != e.suppress || deregister != e.deregister {
+					t.Fatalf("event %d %s: suppress, deregister = %v, %v, want %v, %v",
+						i, e.status, suppress, deregister, e.suppress, e.deregister)
+				}
+			}
+			if f := d.flaps["a"]; f.timer != nil {
+				f.timer.Stop()
+			}
+		})
+	}
+}
+
+func TestRecordTransitionReconcile(t *testing.T) {
+	d, _ := newTestDiscovery(t, &config.Config{FlapTransitions: 2, FlapWindow: 60, FlapPolicy: FlapPolicyDeregister})
+	now := time.Now()
+
+	// A container found stopped while reconciling was not seen to change.
+	for _, msg := range []events.Message{
+		{ID: "a", Status: "start"},
+		reconcileEvent("a", "die"),
+		{ID: "a", Status: "start"},
+	} {
+		if suppress, _ := d.recordTransition(msg, now, time.Minute, time.Minute); suppress {
+			t.Fatalf("%s suppressed, reconcile events must not count as transitions", msg.Status)
+		}
+	}
+}
+
+func TestFlapStableWaits(t *testing.T) {
+	d, _ := newTestDiscovery(t, &config.Config{FlapStable: 120})
+	d.flaps["a"] = &flapState{damped: true, last: time.Now()}
+
+	// A container that changed within the stable period stays damped.
+	d.flapStable("a")
+	if !d.flaps["a"].damped {
+		t.Fatal("container released before the stable period")
+	}
+}
@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types/events"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	LabelCheckTCP         = "discovery.service.check.tcp"
+	LabelCheckHTTP        = "discovery.service.check.http"
+	LabelCheckGrpc        = "discovery.service.check.grpc"
+	LabelCheckGrpcService = "discovery.service.check.grpc.service"
+	LabelCheckInterval    = "discovery.service.check.interval"
+	LabelCheckTimeout     = "discovery.service.check.timeout"
+	LabelCheckFailures    = "discovery.service.check.failures"
+	LabelCheckDeregister  = "discovery.service.check.deregister"
+	CheckTCP              = "tcp"
+	CheckHTTP             = "http"
+	CheckGrpc             = "grpc"
+	StatusHealth          = "health"
+)
+
+type healthCheck struct {
+	kind       string
+	port       string
+	path       string
+	service    string
+	interval   time.Duration
+	timeout    time.Duration
+	failures   int
+	deregister bool
+}
+
+// parseHealthCheck reads the check labels of a container. The http check is
+// defined as port[/path], the tcp and grpc checks as the port.
+func parseHealthCheck(labels map[string]string) *healthCheck {
+	check := &healthCheck{
+		interval:   time.Duration(labelInt(labels, LabelCheckInterval, 10)) * time.Second,
+		timeout:    time.Duration(labelInt(labels, LabelCheckTimeout, 2)) * time.Second,
+		failures:   labelInt(labels, LabelCheckFailures, 3),
+		deregister: labels[LabelCheckDeregister] == "true",
+	}
+
+	if v, ok := labels[LabelCheckGrpc]; ok {
+		check.kind, check.port, check.service = CheckGrpc, v, labels[LabelCheckGrpcService]
+	} else if v, ok := labels[LabelCheckHTTP]; ok {
+		check.kind, check.port, check.path = CheckHTTP, v, "/"
+		if i := strings.Index(v, "/"); i != -1 {
+			check.port, check.path = v[:i], v[i:]
+		}
+	} else if v, ok := labels[LabelCheckTCP]; ok {
+		check.kind, check.port = CheckTCP, v
+	} else {
+		return nil
+	}
+
+	if check.failures < 1 {
+		check.failures = 1
+	}
+	return check
+}
+
+func (d *Discovery) startHealthCheck(c *Container) {
+	d.stopHealthCheck(c.ID)
+
+	check := parseHealthCheck(c.Labels)
+	if check == nil {
+		return
+	}
+	addr, err := d.checkAddress(c, check.port)
+	if err != nil {
+		d.log.Warnf("Health check of %s %s skipped: %v", c.Name, registry.ShortID(c.ID), err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.mu.Lock()
+	d.checks[c.ID] = cancel
+	d.mu.Unlock()
+
+	go d.runHealthCheck(ctx, c.ID, addr, check)
+}
+
+// checkAddress returns the address the health check of a container dials.
+// Containers of the local daemon are probed on their network address, those
+// of remote nodes, whose networks the agent cannot reach, on the node address
+// and the published port.
+func (d *Discovery) checkAddress(c *Container, port string) (string, error) {
+	n := d.containerNode(c.ID)
+	if n == nil || n.Host == "" {
+		return net.JoinHostPort(c.Host, port), nil
+	}
+
+	published, ok := c.published[port]
+	if !ok {
+		return "", fmt.Errorf("port %s is not published on %s", port, n.Name)
+	}
+	host := n.ExternalIP
+	if u, err := url.Parse(n.Host); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	if host == "" {
+		return "", fmt.Errorf("no address of %s", n.Name)
+	}
+	return net.JoinHostPort(host, published), nil
+}
+
+func (d *Discovery) stopHealthCheck(id string) {
+	d.mu.Lock()
+	cancel, ok := d.checks[id]
+	delete(d.checks, id)
+	d.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+func (d *Discovery) runHealthCheck(ctx context.Context, id, addr string, check *healthCheck) {
+	ticker := time.NewTicker(check.interval)
+	defer ticker.Stop()
+
+	failures, reported := 0, ""
+	for {
+		err := check.probe(ctx, addr)
+		if ctx.Err() != nil {
+			return
+		}
+
+		health := ""
+		if err == nil {
+			failures = 0
+			health = registry.HealthPassing
+		} else {
+			failures++
+			d.log.Debugf("Health check %s of %s failed: %v", check.kind, addr, err)
+			if failures >= check.failures {
+				health = registry.HealthCritical
+			}
+		}
+
+		// Transitions go through the worker of the container, so they are
+		// ordered with its start and die events.
+		if health != "" && health != reported {
+			reported = health
+			d.dispatch(events.Message{
+				ID:     id,
+				Status: StatusHealth,
+				Actor:  events.Actor{ID: id, Attributes: map[string]string{"health": health}},
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (check *healthCheck) probe(ctx context.Context, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+
+	switch check.kind {
+	case CheckTCP:
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case CheckHTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+check.path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	case CheckGrpc:
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: check.service})
+		if err != nil {
+			return err
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown check %s", check.kind)
+}
+
+// setHealth publishes a health change of a tracked container. Critical
+// containers are either marked in the endpoint record or, with the deregister
+// label, removed from etcd until the check passes again.
+func (d *Discovery) setHealth(id, health string) {
+	c, updated := d.updateContainer(id, func(c *Container) bool {
+		if c.Health == health {
+			return false
+		}
+		c.Health = health
+		return true
+	})
+	if updated == nil {
+		return
+	}
+
+	d.log.Infof("%s %s is %s", c.Name, registry.ShortID(c.ID), health)
+	check := parseHealthCheck(c.Labels)
+	deregister := check != nil && check.deregister
+	metricHealthChanges.WithLabelValues(c.Name, c.Instance, health).Inc()
+
+	if deregister && health == registry.HealthCritical {
+		d.deleteKeys(c.ID, d.releasableKeys(c.ID, c.Name, c.Instance, c.Keys))
+	} else {
+		if deregister && c.Health == registry.HealthCritical {
+			kv := make(map[string]string, len(updated.kv))
+			for k, v := range updated.kv {
+				kv[k] = v
+			}
+			if _, ok := d.claimOwner(c.ID, c.Node, c.Name, c.Instance, kv); ok {
+				d.putKeys(c.ID, kv)
+			}
+		}
+		d.putEndpoint(updated)
+	}
+
+	d.updateEndpointMetrics(c.Name, c.Instance)
+	d.traefikSync(c.Name, c.Instance)
+	d.registryChanged()
+}
@@ -0,0 +1,41 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"testing"
+)
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		node *dockerNode
+		port string
+		want string
+		ok   bool
+	}{
+		{"unknown node", nil, "9001", "10.0.0.1:9001", true},
+		{"local node", &dockerNode{Name: "local"}, "9001", "10.0.0.1:9001", true},
+		{"remote node", &dockerNode{Name: "remote", Host: "tcp://192.168.0.10:2376"}, "9001", "192.168.0.10:19001", true},
+		{"remote node with external ip", &dockerNode{Name: "remote", Host: "tcp://docker-2:2376", ExternalIP: "1.2.3.4"},
+			"9001", "docker-2:19001", true},
+		{"remote port not published", &dockerNode{Name: "remote", Host: "tcp://192.168.0.10:2376"}, "8080", "", false},
+		{"remote node without address", &dockerNode{Name: "remote", Host: "unix:///var/run/docker.sock"},
+			"9001", "", false},
+		{"remote socket with external ip", &dockerNode{Name: "remote", Host: "unix:///var/run/docker.sock", ExternalIP: "1.2.3.4"},
+			"9001", "1.2.3.4:19001", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDiscovery(t, &config.Config{})
+			c := &Container{ID: "aaaaaaaaaaaa", Host: "10.0.0.1", published: map[string]string{"9001": "19001"}}
+			if tt.node != nil {
+				d.setContainerNode(c.ID, tt.node)
+			}
+
+			addr, err := d.checkAddress(c, tt.port)
+			if (err == nil) != tt.ok || addr != tt.want {
+				t.Fatalf("checkAddress() = %q, %v, want %q, ok %v", addr, err, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"context"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"strings"
+	"time"
+)
+
+type configRef struct {
+	name     string
+	instance string
+}
+
+// recordConfigHistory snapshots every config subtree that differs from its
+// latest snapshot and then every subtree changed under /configs/, including
+// the agents' own configs, until the term ends. Subtrees removed entirely get
+// an empty snapshot, so their removal can be rolled back too.
+func (d *Discovery) recordConfigHistory(ctx context.Context) error {
+	c := client.New(d.etcdClient, 0)
+
+	tctx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	refs, rev, err := d.configRefs(tctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for ref := range refs {
+		if err := d.snapshotConfig(ctx, c, ref, rev); err != nil {
+			return err
+		}
+	}
+
+	wctx, wcancel := context.WithCancel(ctx)
+	defer wcancel()
+	for wresp := range d.etcdClient.Watch(wctx, registry.ConfigsPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+		changed := make(map[configRef]int64)
+		for _, ev := range wresp.Events {
+			name, instance, _, ok := registry.ParseConfigKey(string(ev.Kv.Key))
+			if !ok {
+				continue
+			}
+			ref := configRef{name, instance}
+			if ev.Kv.ModRevision > changed[ref] {
+				changed[ref] = ev.Kv.ModRevision
+			}
+		}
+		for ref, rev := range changed {
+			if err := d.snapshotConfig(ctx, c, ref, rev); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// configRefs returns the service instances with a config or a config history
+// and the revision they were read at.
+func (d *Discovery) configRefs(ctx context.Context) (map[configRef]bool, int64, error) {
+	resp, err := d.etcdClient.Get(ctx, registry.ConfigsPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, 0, err
+	}
+	refs := make(map[configRef]bool)
+	for _, v := range resp.Kvs {
+		if name, instance, _, ok := registry.ParseConfigKey(string(v.Key)); ok {
+			refs[configRef{name, instance}] = true
+		}
+	}
+
+	history, err := d.etcdClient.Get(ctx, registry.HistoryPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, v := range history.Kvs {
+		parts := strings.SplitN(strings.TrimPrefix(string(v.Key), registry.HistoryPrefix), "/", 3)
+		if len(parts) == 3 {
+			refs[configRef{parts[0], parts[1]}] = true
+		}
+	}
+	return refs, resp.Header.Revision, nil
+}
+
+func (d *Discovery) snapshotConfig(ctx context.Context, c *client.Client, ref configRef, rev int64) error {
+	tctx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	s, err := c.Snapshot(tctx, ref.name, ref.instance, rev, d.cfg.HistoryLimit)
+	if err != nil {
+		metricETCDErrors.WithLabelValues("put").Inc()
+		return err
+	}
+	if s != nil {
+		d.log.Infof("Config of %s/%s changed, snapshot at revision %d", ref.name, ref.instance, s.Revision)
+		metricConfigSnapshots.WithLabelValues(ref.name, ref.instance).Inc()
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"context"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/election"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LeaderResignTimeout = 5 * time.Second
+)
+
+// leaderTask is a cluster-wide duty run every interval by the elected agent
+// only. With no interval run is called once for the whole term and again
+// after an error. reset, when set, is called at the start of every term.
+type leaderTask struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+	reset    func()
+}
+
+// initLeaderTasks registers the leader-only tasks. Add new cluster-wide duties
+// here.
+func (d *Discovery) initLeaderTasks() {
+	ttl := time.Duration(d.nodeTTL()) * time.Second
+	missing := make(map[string]time.Time)
+	d.addLeaderTask(&leaderTask{
+		name:     "dead-nodes",
+		interval: ttl,
+		run: func(ctx context.Context) error {
+			return d.cleanupDeadNodes(ctx, missing)
+		},
+		reset: func() {
+			missing = make(map[string]time.Time)
+		},
+	})
+
+	if d.cfg.GCInterval > 0 {
+		d.addLeaderTask(&leaderTask{
+			name:     "gc",
+			interval: time.Duration(d.cfg.GCInterval) * time.Second,
+			run:      d.collectGarbage,
+		})
+	}
+
+	d.addLeaderTask(&leaderTask{
+		name: "config-validation",
+		run:  d.watchConfigs,
+	})
+
+	if d.cfg.HistoryLimit > 0 {
+		d.addLeaderTask(&leaderTask{
+			name: "config-history",
+			run:  d.recordConfigHistory,
+		})
+	}
+}
+
+func (d *Discovery) addLeaderTask(t *leaderTask) {
+	d.leaderTasks = append(d.leaderTasks, t)
+}
+
+func (d *Discovery) isLeader() bool {
+	return atomic.LoadInt32(&d.leading) == 1
+}
+
+// runLeader campaigns for the leadership among the agents and runs the
+// leader tasks while elected. The per-host registration work does not depend
+// on the outcome. On shutdown the leadership is resigned, so another agent
+// takes over at once instead of after the lease TTL.
+func (d *Discovery) runLeader() {
+	defer close(d.leaderDone)
+
+	for d.ctx.Err() == nil {
+		if err := d.election.Campaign(d.ctx, d.agentName); err != nil {
+			if d.ctx.Err() == nil {
+				d.log.Errorf("Leader election error: %v", err)
+			}
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(DockerReconnectDelay):
+			}
+			continue
+		}
+
+		d.log.Infof("Elected as leader")
+		atomic.StoreInt32(&d.leading, 1)
+		metricLeader.Set(1)
+
+		d.lead(d.election.Done())
+
+		atomic.StoreInt32(&d.leading, 0)
+		metricLeader.Set(0)
+		ctx, cancel := context.WithTimeout(context.Background(), LeaderResignTimeout)
+		if err := d.election.Resign(ctx); err != nil && err != election.ErrNotLeader {
+			d.log.Errorf("Leader resign error: %v", err)
+		}
+		cancel()
+		d.log.Infof("Resigned as leader")
+	}
+}
+
+// lead runs the leader tasks until the agent stops or loses the lease.
+func (d *Discovery) lead(lost <-chan struct{}) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	var wg sync.WaitGroup
+	for _, t := range d.leaderTasks {
+		if t.reset != nil {
+			t.reset()
+		}
+		wg.Add(1)
+		go func(t *leaderTask) {
+			defer wg.Done()
+			d.runLeaderTask(ctx, t)
+		}(t)
+	}
+
+	select {
+	case <-d.ctx.Done():
+	case <-lost:
+		d.log.Warnf("Leader lease lost")
+	}
+	cancel()
+	wg.Wait()
+}
+
+func (d *Discovery) runLeaderTask(ctx context.Context, t *leaderTask) {
+	if t.interval == 0 {
+		for ctx.Err() == nil {
+			if err := t.run(ctx); err != nil && ctx.Err() == nil {
+				d.log.Errorf("Leader task %s error: %v", t.name, err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(DockerReconnectDelay):
+			}
+		}
+		return
+	}
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tctx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+			if err := t.run(tctx); err != nil && ctx.Err() == nil {
+				d.log.Errorf("Leader task %s error: %v", t.name, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// collectGarbage removes registry keys no consumer can use, as sdctl gc does.
+func (d *Discovery) collectGarbage(ctx context.Context) error {
+	keys, err := client.New(d.etcdClient, 0).GC(ctx, false)
+	for _, k := range keys {
+		d.log.Infof("Removed orphaned key %s", k)
+	}
+	return err
+}
@@ -0,0 +1,234 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types/events"
+	"go.etcd.io/etcd/clientv3"
+	"time"
+)
+
+const (
+	StatusMaintenance = "maintenance"
+	StatusRotation    = "rotation"
+)
+
+type rotationRetry struct {
+	attempts int
+	timer    *time.Timer
+}
+
+// watchMaintenance applies the states written under the maintenance prefix
+// by sdctl or the admin API to the tracked containers.
+func (d *Discovery) watchMaintenance() {
+	for d.ctx.Err() == nil {
+		ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+		resp, err := d.etcdClient.Get(ctx, registry.MaintenancePrefix, clientv3.WithPrefix())
+		cancel()
+		if err != nil {
+			d.log.Errorf("Maintenance keys read error: %v", err)
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(DockerReconnectDelay):
+			}
+			continue
+		}
+
+		for _, v := range resp.Kvs {
+			d.applyMaintenance(string(v.Key), string(v.Value))
+		}
+
+		wch := d.etcdClient.Watch(d.ctx, registry.MaintenancePrefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				d.log.Errorf("Maintenance watch error: %v", wresp.Err())
+				break
+			}
+			for _, ev := range wresp.Events {
+				value := string(ev.Kv.Value)
+				if ev.Type == clientv3.EventTypeDelete {
+					value = ""
+				}
+				d.applyMaintenance(string(ev.Kv.Key), value)
+			}
+		}
+	}
+}
+
+func (d *Discovery) applyMaintenance(key, state string) {
+	name, instance, id, ok := registry.ParseMaintenanceKey(key)
+	if !ok {
+		return
+	}
+	if state != "" && state != registry.StateMaintenance && state != registry.StateDraining {
+		d.log.Errorf("Unknown state %q in %s", state, key)
+		return
+	}
+
+	// The state is applied by the worker of the container, so it is ordered
+	// with its start and die events.
+	for _, c := range d.replicas(name, instance) {
+		if registry.ShortID(c.ID) == id {
+			d.dispatch(events.Message{
+				ID:     c.ID,
+				Status: StatusMaintenance,
+				Actor:  events.Actor{ID: c.ID, Attributes: map[string]string{"state": state}},
+			})
+		}
+	}
+}
+
+// maintenanceState returns the state stored for the container when it is
+// registered, so maintenance survives restarts of the agent.
+func (d *Discovery) maintenanceState(c *Container) string {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Get(ctx, registry.MaintenanceKey(c.Name, c.Instance, registry.ShortID(c.ID)))
+	if err != nil || len(resp.Kvs) == 0 {
+		return ""
+	}
+	return string(resp.Kvs[0].Value)
+}
+
+// syncRotation withholds the DNS record and the aggregate host and ports keys
+// of a container leaving rotation and restores them on return. While it
+// leaves, the aggregate keys it holds move with the owner record to another
+// routable replica or, when there is none, are removed and the container
+// stays the owner. The aggregate keys are written with compare-and-swap
+// rather than through the outbox, so a failed write is retried by running
+// syncRotation again.
+func (d *Discovery) syncRotation(c *Container) {
+	if d.cfg.SkyDNSDomain != "" {
+		key := d.skyDNSKey(c.Name, c.Instance, c.ID)
+		if value, ok := c.kv[key]; ok {
+			if c.routable() {
+				d.putKeys(c.ID, map[string]string{key: value})
+			} else {
+				d.deleteKeys(c.ID, []string{key})
+			}
+		}
+	}
+
+	if c.routable() {
+		d.rotationResult(c.ID, d.restoreAggregate(c))
+		return
+	}
+
+	hostKey := fmt.Sprintf(ETCDHostPattern, c.Name, c.Instance)
+	ops := make([]clientv3.Op, 0, 4)
+	for _, r := range d.replicas(c.Name, c.Instance) {
+		if r.ID == c.ID || !r.routable() {
+			continue
+		}
+		for _, k := range legacyKeys(c.Name, c.Instance) {
+			if v, ok := r.kv[k]; ok {
+				ops = append(ops, clientv3.OpPut(k, v))
+			}
+		}
+		if len(ops) == 0 {
+			continue
+		}
+		owner, err := (&registry.Owner{Node: r.Node, Container: registry.ShortID(r.ID)}).Marshal()
+		if err != nil {
+			d.log.Errorf("Owner record error: %v", err)
+			return
+		}
+		ops = append(ops, clientv3.OpPut(fmt.Sprintf(registry.OwnerPattern, c.Name, c.Instance), owner))
+		break
+	}
+	if len(ops) == 0 {
+		for _, k := range legacyKeys(c.Name, c.Instance) {
+			ops = append(ops, clientv3.OpDelete(k))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	_, err := d.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(hostKey), "=", c.Host)).
+		Then(ops...).
+		Commit()
+	cancel()
+	d.rotationResult(c.ID, err)
+}
+
+// restoreAggregate writes the aggregate host and ports keys of a container
+// back when it returns to service, if it still owns the service or nobody
+// holds the keys, in which case it claims the owner record.
+func (d *Discovery) restoreAggregate(c *Container) error {
+	ops := make([]clientv3.Op, 0, 4)
+	for _, k := range legacyKeys(c.Name, c.Instance) {
+		if v, ok := c.kv[k]; ok {
+			ops = append(ops, clientv3.OpPut(k, v))
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, c.Name, c.Instance)
+	owner, err := (&registry.Owner{Node: c.Node, Container: registry.ShortID(c.ID)}).Marshal()
+	if err != nil {
+		d.log.Errorf("Owner record error: %v", err)
+		return nil
+	}
+	hostKey := fmt.Sprintf(ETCDHostPattern, c.Name, c.Instance)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(ownerKey), "=", owner)).
+		Then(ops...).
+		Commit()
+	if err == nil && !resp.Succeeded {
+		_, err = d.etcdClient.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(hostKey), "=", 0)).
+			Then(append(ops, clientv3.OpPut(ownerKey, owner))...).
+			Commit()
+	}
+	return err
+}
+
+// rotationResult schedules syncRotation of the container again when its
+// aggregate keys could not be written, backing off like the outbox. The
+// retry runs on the worker of the container with its state at that time.
+func (d *Discovery) rotationResult(id string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.rotations[id]
+	if err == nil {
+		if ok {
+			r.timer.Stop()
+			delete(d.rotations, id)
+		}
+		return
+	}
+
+	metricETCDErrors.WithLabelValues("put").Inc()
+	if !ok {
+		r = &rotationRetry{}
+		d.rotations[id] = r
+	} else {
+		r.timer.Stop()
+	}
+	backoff := outboxBackoff(r.attempts)
+	r.attempts++
+	r.timer = time.AfterFunc(backoff, func() {
+		d.dispatch(events.Message{ID: id, Status: StatusRotation})
+	})
+	d.log.Errorf("Aggregate keys of %s write error, retrying in %s: %v", registry.ShortID(id), backoff, err)
+}
+
+// retryRotation runs syncRotation again for a container whose aggregate keys
+// could not be written.
+func (d *Discovery) retryRotation(id string) {
+	d.mu.RLock()
+	c, ok := d.containers[id]
+	d.mu.RUnlock()
+	if !ok {
+		d.rotationResult(id, nil)
+		return
+	}
+	d.syncRotation(c)
+}
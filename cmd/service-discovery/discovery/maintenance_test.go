@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"reflect"
+	"testing"
+)
+
+func TestSyncRotation(t *testing.T) {
+	hostKey := fmt.Sprintf(ETCDHostPattern, "billing", "dev")
+	portKey := fmt.Sprintf(ETCDPortsGrpcPattern, "billing", "dev")
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, "billing", "dev")
+	ownerA := testOwner(t, "node-a", "aaaaaaaaaaaa")
+	ownerB := testOwner(t, "node-a", "bbbbbbbbbbbb")
+
+	replica := &Container{ID: "bbbbbbbbbbbb", Node: "node-a", Name: "billing", Instance: "dev", Host: "10.0.0.2",
+		kv: map[string]string{hostKey: "10.0.0.2", portKey: "9002"}}
+	merged := &Container{ID: "cccccccccccc", Node: "node-b", Name: "billing", Instance: "dev", Host: "10.0.0.3",
+		kv: map[string]string{}}
+
+	tests := []struct {
+		name     string
+		state    string
+		etcd     map[string]string
+		replicas []*Container
+		want     map[string]string
+	}{
+		{"leaving hands the keys and the owner to a replica", registry.StateMaintenance,
+			map[string]string{hostKey: "10.0.0.1", portKey: "9001", ownerKey: ownerA},
+			[]*Container{replica},
+			map[string]string{hostKey: "10.0.0.2", portKey: "9002", ownerKey: ownerB}},
+		{"leaving without replicas removes the keys", registry.StateMaintenance,
+			map[string]string{hostKey: "10.0.0.1", portKey: "9001", ownerKey: ownerA},
+			nil,
+			map[string]string{ownerKey: ownerA}},
+		{"leaving skips merged replicas", registry.StateDraining,
+			map[string]string{hostKey: "10.0.0.1", portKey: "9001", ownerKey: ownerA},
+			[]*Container{merged},
+			map[string]string{ownerKey: ownerA}},
+		{"returning owner restores the keys", "",
+			map[string]string{ownerKey: ownerA},
+			nil,
+			map[string]string{hostKey: "10.0.0.1", portKey: "9001", ownerKey: ownerA}},
+		{"returning after a handover keeps the replica", "",
+			map[string]string{hostKey: "10.0.0.2", portKey: "9002", ownerKey: ownerB},
+			[]*Container{replica},
+			map[string]string{hostKey: "10.0.0.2", portKey: "9002", ownerKey: ownerB}},
+		{"returning to a released service claims it", "",
+			map[string]string{ownerKey: testOwner(t, "node-b", "dddddddddddd")},
+			nil,
+			map[string]string{hostKey: "10.0.0.1", portKey: "9001", ownerKey: ownerA}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, kv := newTestDiscovery(t, &config.Config{})
+			for k, v := range tt.etcd {
+				if _, err := d.etcdClient.Put(d.ctx, k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, r := range tt.replicas {
+				d.track(r)
+			}
+			c := &Container{ID: "aaaaaaaaaaaa", Node: "node-a", Name: "billing", Instance: "dev", Host: "10.0.0.1",
+				State: tt.state, kv: map[string]string{hostKey: "10.0.0.1", portKey: "9001"}}
+			d.track(c)
+
+			d.syncRotation(c)
+			if got := kv.snapshot(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("keys = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncRotationRetry(t *testing.T) {
+	hostKey := fmt.Sprintf(ETCDHostPattern, "billing", "dev")
+	ownerKey := fmt.Sprintf(registry.OwnerPattern, "billing", "dev")
+	d, kv := newTestDiscovery(t, &config.Config{})
+	d.startWorkers()
+	if _, err := d.etcdClient.Put(d.ctx, hostKey, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	d.track(&Container{ID: "bbbbbbbbbbbb", Node: "node-a", Name: "billing", Instance: "dev", Host: "10.0.0.2",
+		kv: map[string]string{hostKey: "10.0.0.2"}})
+	c := &Container{ID: "aaaaaaaaaaaa", Node: "node-a", Name: "billing", Instance: "dev", Host: "10.0.0.1",
+		State: registry.StateMaintenance, kv: map[string]string{hostKey: "10.0.0.1"}}
+	d.track(c)
+
+	kv.setErr(errors.New("etcd unavailable"))
+	d.syncRotation(c)
+	d.mu.RLock()
+	r := d.rotations[c.ID]
+	d.mu.RUnlock()
+	if r == nil || r.attempts != 1 {
+		t.Fatalf("retry after a failed write = %+v, want 1 attempt", r)
+	}
+
+	// The retry runs on the worker of the container once etcd is back.
+	kv.setErr(nil)
+	waitFor(t, func() bool {
+		owner, _ := kv.value(ownerKey)
+		return owner == testOwner(t, "node-a", "bbbbbbbbbbbb")
+	})
+	if host, _ := kv.value(hostKey); host != "10.0.0.2" {
+		t.Fatalf("host = %s, want the replica's", host)
+	}
+	waitFor(t, func() bool {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return len(d.rotations) == 0
+	})
+}
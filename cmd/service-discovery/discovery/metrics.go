@@ -0,0 +1,206 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MetricsNamespace = "service_discovery"
+)
+
+var (
+	metricDockerEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "docker_events_total",
+		Help:      "Docker events received by object type and action.",
+	}, []string{"type", "action"})
+	metricRegistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "registrations_total",
+		Help:      "Container registrations.",
+	}, []string{"service", "instance"})
+	metricRegistrationsDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "registrations_denied_total",
+		Help:      "Container registrations denied by label validation or the registration policy.",
+	}, []string{"service", "instance"})
+	metricConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "conflicts_total",
+		Help:      "Registrations of services owned by another node by applied policy.",
+	}, []string{"service", "instance", "policy"})
+	metricDeadNodeCleanups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "dead_node_cleanups_total",
+		Help:      "Endpoints removed because their node is dead.",
+	})
+	metricLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "leader",
+		Help:      "Whether the agent is the elected leader.",
+	})
+	metricConfigSeeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "config_seeded_total",
+		Help:      "Config keys seeded from container labels and files.",
+	}, []string{"service", "instance"})
+	metricConfigSnapshots = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "config_snapshots_total",
+		Help:      "Config snapshots stored for rollback.",
+	}, []string{"service", "instance"})
+	metricConfigViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "config_violations_total",
+		Help:      "Config values violating the schema of their service.",
+	}, []string{"service", "instance"})
+	metricDeregistrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "deregistrations_total",
+		Help:      "Container deregistrations.",
+	}, []string{"service", "instance"})
+	metricETCDErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "etcd_errors_total",
+		Help:      "Failed etcd operations.",
+	}, []string{"op"})
+	metricReconcileCorrections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "reconcile_corrections_total",
+		Help:      "Containers registered or deregistered by reconciliation after missed events.",
+	})
+	metricStreamReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "docker_stream_reconnects_total",
+		Help:      "Docker event stream reconnects.",
+	}, []string{"node"})
+	metricDockerConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "docker_connected",
+		Help:      "Whether the Docker event stream of the node is connected.",
+	}, []string{"node"})
+	metricETCDDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "etcd_operation_duration_seconds",
+		Help:      "Duration of etcd operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+	metricInspectDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "docker_inspect_duration_seconds",
+		Help:      "Duration of Docker container inspects.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricTrackedContainers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "tracked_containers",
+		Help:      "Containers registered by the agent.",
+	})
+	metricEndpoints = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "registered_endpoints",
+		Help:      "Endpoints registered by the agent per service.",
+	}, []string{"service", "instance"})
+	metricHealthyEndpoints = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "healthy_endpoints",
+		Help:      "Registered endpoints not failing their health check per service.",
+	}, []string{"service", "instance"})
+	metricOutboxDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "outbox_depth",
+		Help:      "Containers with etcd mutations waiting for retry.",
+	})
+	metricQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "event_queue_length",
+		Help:      "Events waiting in the queue of each worker.",
+	}, []string{"worker"})
+	metricQueueBlocked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "event_queue_blocked_total",
+		Help:      "Events that waited for a full worker queue.",
+	})
+	metricQueueBlockedDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "event_queue_blocked_seconds",
+		Help:      "Time spent waiting for a full worker queue.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	metricFlapping = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "flapping_total",
+		Help:      "Containers damped for flapping.",
+	})
+	metricFlapSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "flap_suppressed_total",
+		Help:      "Transitions of flapping containers not applied to the registry.",
+	})
+	metricDrains = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "drains_total",
+		Help:      "Containers taken out of rotation before deregistration.",
+	}, []string{"service", "instance"})
+	metricHealthChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "health_changes_total",
+		Help:      "Health check status changes by resulting status.",
+	}, []string{"service", "instance", "health"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricDockerEvents,
+		metricRegistrations,
+		metricRegistrationsDenied,
+		metricConflicts,
+		metricDeregistrations,
+		metricDeadNodeCleanups,
+		metricLeader,
+		metricConfigSeeded,
+		metricConfigSnapshots,
+		metricConfigViolations,
+		metricETCDErrors,
+		metricReconcileCorrections,
+		metricStreamReconnects,
+		metricDockerConnected,
+		metricETCDDuration,
+		metricInspectDuration,
+		metricTrackedContainers,
+		metricEndpoints,
+		metricHealthyEndpoints,
+		metricHealthChanges,
+		metricDrains,
+		metricOutboxDepth,
+		metricQueueLength,
+		metricQueueBlocked,
+		metricQueueBlockedDuration,
+		metricFlapping,
+		metricFlapSuppressed,
+	)
+}
+
+func (d *Discovery) updateEndpointMetrics(serviceName, serviceInstance string) {
+	d.mu.RLock()
+	tracked := len(d.containers)
+	d.mu.RUnlock()
+	metricTrackedContainers.Set(float64(tracked))
+
+	replicas := d.replicas(serviceName, serviceInstance)
+	if len(replicas) == 0 {
+		metricEndpoints.DeleteLabelValues(serviceName, serviceInstance)
+		metricHealthyEndpoints.DeleteLabelValues(serviceName, serviceInstance)
+		return
+	}
+
+	healthy := 0
+	for _, c := range replicas {
+		if c.Health != registry.HealthCritical {
+			healthy++
+		}
+	}
+	metricEndpoints.WithLabelValues(serviceName, serviceInstance).Set(float64(len(replicas)))
+	metricHealthyEndpoints.WithLabelValues(serviceName, serviceInstance).Set(float64(healthy))
+}
@@ -0,0 +1,281 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var Version = "dev"
+
+func (d *Discovery) nodeTTL() int {
+	if d.cfg.NodeTTL < 1 {
+		return 1
+	}
+	return d.cfg.NodeTTL
+}
+
+// nodeRecord describes the Docker node for the node registry.
+func (d *Discovery) nodeRecord(n *dockerNode) *registry.Node {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return &registry.Node{
+		Name:          n.Name,
+		Agent:         d.agentName,
+		IPs:           n.ips,
+		DockerVersion: n.dockerVersion,
+		AgentVersion:  Version,
+		Started:       d.started,
+	}
+}
+
+// nodeIPs returns the addresses of the machine for the local daemon and the
+// daemon host and external IP for remote ones.
+func nodeIPs(n *dockerNode) []string {
+	ips := make([]string, 0)
+	if n.ExternalIP != "" {
+		ips = append(ips, n.ExternalIP)
+	}
+	if n.Host != "" {
+		if u, err := url.Parse(n.Host); err == nil && u.Hostname() != "" && u.Hostname() != n.ExternalIP {
+			ips = append(ips, u.Hostname())
+		}
+		return ips
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	return ips
+}
+
+func (d *Discovery) putNode(n *dockerNode) {
+	d.mu.RLock()
+	lease := d.nodeLease
+	d.mu.RUnlock()
+	if lease == 0 {
+		return
+	}
+
+	value, err := d.nodeRecord(n).Marshal()
+	if err != nil {
+		d.log.Errorf("Node record error: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	if _, err := d.etcdClient.Put(ctx, registry.NodeKey(n.Name), value, clientv3.WithLease(lease)); err != nil {
+		metricETCDErrors.WithLabelValues("put").Inc()
+		d.log.Errorf("Node record %s write error: %v", n.Name, err)
+	}
+}
+
+// nodeConnected refreshes the Docker version in the node record after the
+// event stream of the node connected.
+func (d *Discovery) nodeConnected(n *dockerNode) {
+	version, err := n.client.ServerVersion(d.ctx)
+	if err != nil {
+		d.log.Errorf("Docker version of %s error: %v", n.Name, err)
+		return
+	}
+	d.mu.Lock()
+	n.dockerVersion = version.Version
+	d.mu.Unlock()
+	d.putNode(n)
+}
+
+// keepNodes writes the node records under a lease kept alive by the agent.
+// The lease is not revoked on shutdown, so a restart within the node grace
+// period does not deregister the services of the agent.
+func (d *Discovery) keepNodes() {
+	for d.ctx.Err() == nil {
+		keepAlive, err := d.grantNodeLease(int64(d.nodeTTL()))
+		if err != nil {
+			d.log.Errorf("Node lease error: %v", err)
+		} else {
+			for _, n := range d.nodes {
+				d.putNode(n)
+			}
+			for range keepAlive {
+			}
+			if d.ctx.Err() == nil {
+				d.log.Warnf("Node lease lost, registering the nodes again")
+			}
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(DockerReconnectDelay):
+		}
+	}
+}
+
+func (d *Discovery) grantNodeLease(ttl int64) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	grant, err := d.etcdClient.Grant(ctx, ttl)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	keepAlive, err := d.etcdClient.KeepAlive(d.ctx, grant.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.nodeLease = grant.ID
+	d.mu.Unlock()
+	return keepAlive, nil
+}
+
+// cleanupDeadNodes removes the endpoint records, the host and ports keys they
+// own and the DNS records of nodes whose record has been gone for the node
+// grace period. Endpoints without a node, e.g. static ones, are kept.
+func (d *Discovery) cleanupDeadNodes(ctx context.Context, missing map[string]time.Time) error {
+	nodes, err := d.etcdClient.Get(ctx, registry.NodesPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	alive := make(map[string]bool, len(nodes.Kvs))
+	for _, v := range nodes.Kvs {
+		alive[strings.TrimPrefix(string(v.Key), registry.NodesPrefix)] = true
+	}
+
+	services, err := d.etcdClient.Get(ctx, registry.ServicesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	grace := time.Duration(d.cfg.NodeGrace) * time.Second
+	dead := func(node string) bool {
+		if node == "" || alive[node] {
+			delete(missing, node)
+			return false
+		}
+		since, ok := missing[node]
+		if !ok {
+			missing[node] = now
+			return false
+		}
+		return now.Sub(since) >= grace
+	}
+
+	for _, v := range services.Kvs {
+		key := string(v.Key)
+		name, instance, ok := registry.ParseKey(key)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(key, fmt.Sprintf(registry.EndpointsPattern, name, instance)):
+			e, err := registry.ParseEndpoint(v.Value)
+			if err != nil || !dead(e.Node) {
+				continue
+			}
+			d.log.Infof("Removing %s/%s %s of dead node %s", name, instance, e.ID, e.Node)
+			keys := []string{key, registry.MaintenanceKey(name, instance, e.ID)}
+			if d.cfg.SkyDNSDomain != "" {
+				keys = append(keys, d.skyDNSKey(name, instance, e.ID))
+			}
+			if d.cfg.TraefikPrefix != "" {
+				keys = append(keys, d.traefikServerKey(name, instance, e.ID))
+			}
+			for _, k := range keys {
+				if _, err := d.etcdClient.Delete(ctx, k); err != nil {
+					return err
+				}
+			}
+			metricDeadNodeCleanups.Inc()
+		case key == fmt.Sprintf(registry.OwnerPattern, name, instance):
+			owner, err := registry.ParseOwner(v.Value)
+			if err != nil || !dead(owner.Node) {
+				continue
+			}
+			ops := []clientv3.Op{clientv3.OpDelete(key)}
+			for _, k := range legacyKeys(name, instance) {
+				ops = append(ops, clientv3.OpDelete(k))
+			}
+			_, err = d.etcdClient.Txn(ctx).
+				If(clientv3.Compare(clientv3.Value(key), "=", string(v.Value))).
+				Then(ops...).
+				Commit()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type nodeEndpoint struct {
+	name     string
+	instance string
+	endpoint *registry.Endpoint
+}
+
+// nodeEndpoints returns the endpoint records of the node in etcd.
+func (d *Discovery) nodeEndpoints(n *dockerNode) ([]*nodeEndpoint, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Get(ctx, registry.ServicesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*nodeEndpoint, 0)
+	for _, v := range resp.Kvs {
+		key := string(v.Key)
+		name, instance, ok := registry.ParseKey(key)
+		if !ok || !strings.HasPrefix(key, fmt.Sprintf(registry.EndpointsPattern, name, instance)) {
+			continue
+		}
+		e, err := registry.ParseEndpoint(v.Value)
+		if err != nil || e.Node != n.Name || e.ID == "" {
+			continue
+		}
+		res = append(res, &nodeEndpoint{name: name, instance: instance, endpoint: e})
+	}
+	return res, nil
+}
+
+// removeEndpoint removes the records of a container of the node that is no
+// longer running, with the host and ports keys if it still owns them.
+func (d *Discovery) removeEndpoint(n *dockerNode, r *nodeEndpoint) {
+	id := r.endpoint.ID
+	d.log.Infof("Removing %s/%s %s of %s, the container is gone", r.name, r.instance, id, n.Name)
+
+	keys := []string{
+		registry.EndpointKey(r.name, r.instance, id),
+		registry.MaintenanceKey(r.name, r.instance, id),
+	}
+	if d.cfg.SkyDNSDomain != "" {
+		keys = append(keys, d.skyDNSKey(r.name, r.instance, id))
+	}
+	if d.cfg.TraefikPrefix != "" {
+		keys = append(keys, d.traefikServerKey(r.name, r.instance, id))
+	}
+	owner, _, err := d.readOwner(r.name, r.instance)
+	if err != nil {
+		d.log.Errorf("Owner record of %s/%s read error: %v", r.name, r.instance, err)
+	} else if owner != nil && owner.Node == n.Name && owner.Container == id {
+		keys = append(keys, legacyKeys(r.name, r.instance)...)
+		keys = append(keys, fmt.Sprintf(registry.OwnerPattern, r.name, r.instance))
+	}
+
+	d.deleteKeys(id, keys)
+	d.traefikSync(r.name, r.instance)
+}
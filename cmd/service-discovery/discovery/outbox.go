@@ -0,0 +1,257 @@
+package discovery
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OutboxRetryInterval = time.Second
+	OutboxMinBackoff    = time.Second
+	OutboxMaxBackoff    = time.Minute
+	OutboxFlushLocks    = 64
+)
+
+type outboxEntry struct {
+	Put      map[string]string `json:"put,omitempty"`
+	Delete   map[string]bool   `json:"delete,omitempty"`
+	Attempts int               `json:"attempts"`
+	Next     time.Time         `json:"next"`
+}
+
+// outbox holds the etcd mutations of every container that have not been
+// applied yet. Mutations of the same key collapse, so only the latest state
+// of a container is retried. Flushes of one container are serialized, so a
+// retry cannot write back a value the worker deleted meanwhile.
+type outbox struct {
+	mu      sync.Mutex
+	entries map[string]*outboxEntry
+	file    string
+	flushMu [OutboxFlushLocks]sync.Mutex
+}
+
+func newOutbox(file string) (*outbox, error) {
+	o := &outbox{
+		entries: make(map[string]*outboxEntry),
+		file:    file,
+	}
+	if file == "" {
+		return o, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &o.entries); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *outbox) enqueue(id string, put map[string]string, del []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, e := range o.entries {
+		for k := range put {
+			delete(e.Delete, k)
+		}
+		for _, k := range del {
+			delete(e.Put, k)
+		}
+	}
+
+	e, ok := o.entries[id]
+	if !ok {
+		e = &outboxEntry{
+			Put:    make(map[string]string),
+			Delete: make(map[string]bool),
+		}
+		o.entries[id] = e
+	}
+	for k, v := range put {
+		e.Put[k] = v
+	}
+	for _, k := range del {
+		e.Delete[k] = true
+	}
+	e.Next = time.Time{}
+	o.compact()
+}
+
+// flushLock returns the lock serializing the flushes of the container. Locks
+// are shared by hash, like the worker queues.
+func (o *outbox) flushLock(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &o.flushMu[h.Sum32()%OutboxFlushLocks]
+}
+
+func (o *outbox) compact() {
+	for id, e := range o.entries {
+		if len(e.Put) == 0 && len(e.Delete) == 0 {
+			delete(o.entries, id)
+		}
+	}
+}
+
+// prune drops the queued writes of containers that are no longer running,
+// e.g. restored from the file after a restart of the agent. Their deletes are
+// kept.
+func (o *outbox) prune(stopped func(id string) bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for id, e := range o.entries {
+		if !strings.HasPrefix(id, TraefikOutboxPrefix) && stopped(id) {
+			e.Put = make(map[string]string)
+		}
+	}
+	o.compact()
+}
+
+func (o *outbox) depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+func (o *outbox) due(now time.Time) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ids := make([]string, 0)
+	for id, e := range o.entries {
+		if !e.Next.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (o *outbox) save() error {
+	if o.file == "" {
+		return nil
+	}
+	o.mu.Lock()
+	data, err := json.Marshal(o.entries)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.file, data)
+}
+
+// putKeys and deleteKeys queue the mutations of a container and apply them
+// right away; whatever fails is retried by retryOutbox.
+func (d *Discovery) putKeys(id string, etcdKv map[string]string) {
+	d.outbox.enqueue(id, etcdKv, nil)
+	d.flushOutbox(id)
+}
+
+func (d *Discovery) deleteKeys(id string, keys []string) {
+	d.outbox.enqueue(id, nil, keys)
+	d.flushOutbox(id)
+}
+
+func (d *Discovery) flushOutbox(id string) {
+	flushMu := d.outbox.flushLock(id)
+	flushMu.Lock()
+	defer flushMu.Unlock()
+
+	d.outbox.mu.Lock()
+	e, ok := d.outbox.entries[id]
+	if !ok {
+		d.outbox.mu.Unlock()
+		return
+	}
+	put := make(map[string]string, len(e.Put))
+	for k, v := range e.Put {
+		put[k] = v
+	}
+	del := make([]string, 0, len(e.Delete))
+	for k := range e.Delete {
+		del = append(del, k)
+	}
+	d.outbox.mu.Unlock()
+
+	var failed error
+	deleted := make([]string, 0, len(del))
+	for _, k := range del {
+		if err := d.etcdDelete(k); err != nil {
+			failed = err
+			continue
+		}
+		deleted = append(deleted, k)
+	}
+	written := make(map[string]string, len(put))
+	for k, v := range put {
+		if err := d.etcdPut(k, v); err != nil {
+			failed = err
+			continue
+		}
+		written[k] = v
+	}
+
+	d.outbox.mu.Lock()
+	if e, ok := d.outbox.entries[id]; ok {
+		for _, k := range deleted {
+			delete(e.Delete, k)
+		}
+		for k, v := range written {
+			if e.Put[k] == v {
+				delete(e.Put, k)
+			}
+		}
+		if failed != nil {
+			e.Next = time.Now().Add(outboxBackoff(e.Attempts))
+			e.Attempts++
+		}
+		d.outbox.compact()
+	}
+	d.outbox.mu.Unlock()
+
+	if failed != nil {
+		d.log.Errorf("Error writing to ETCD, %s queued for retry: %v", id, failed)
+	}
+	metricOutboxDepth.Set(float64(d.outbox.depth()))
+	if err := d.outbox.save(); err != nil {
+		d.log.Errorf("Outbox save error: %v", err)
+	}
+}
+
+// outboxBackoff returns the delay before the next retry after the given
+// number of failed attempts.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := OutboxMinBackoff << uint(attempts)
+	if backoff > OutboxMaxBackoff || backoff <= 0 {
+		backoff = OutboxMaxBackoff
+	}
+	return backoff
+}
+
+func (d *Discovery) retryOutbox() {
+	ticker := time.NewTicker(OutboxRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, id := range d.outbox.due(now) {
+				d.flushOutbox(id)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"errors"
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutboxEnqueue(t *testing.T) {
+	type op struct {
+		id  string
+		put map[string]string
+		del []string
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		want map[string]*outboxEntry
+	}{
+		{"put", []op{
+			{id: "a", put: map[string]string{"k": "1"}},
+		}, map[string]*outboxEntry{
+			"a": {Put: map[string]string{"k": "1"}, Delete: map[string]bool{}},
+		}},
+		{"latest put wins", []op{
+			{id: "a", put: map[string]string{"k": "1"}},
+			{id: "a", put: map[string]string{"k": "2"}},
+		}, map[string]*outboxEntry{
+			"a": {Put: map[string]string{"k": "2"}, Delete: map[string]bool{}},
+		}},
+		{"delete cancels put", []op{
+			{id: "a", put: map[string]string{"k": "1", "j": "1"}},
+			{id: "a", del: []string{"k"}},
+		}, map[string]*outboxEntry{
+			"a": {Put: map[string]string{"j": "1"}, Delete: map[string]bool{"k": true}},
+		}},
+		{"put cancels delete", []op{
+			{id: "a", del: []string{"k"}},
+			{id: "a", put: map[string]string{"k": "1"}},
+		}, map[string]*outboxEntry{
+			"a": {Put: map[string]string{"k": "1"}, Delete: map[string]bool{}},
+		}},
+		{"delete of another container cancels put", []op{
+			{id: "a", put: map[string]string{"k": "1"}},
+			{id: "b", del: []string{"k"}},
+		}, map[string]*outboxEntry{
+			"b": {Put: map[string]string{}, Delete: map[string]bool{"k": true}},
+		}},
+		{"put of another container cancels delete", []op{
+			{id: "a", del: []string{"k"}},
+			{id: "b", put: map[string]string{"k": "1"}},
+		}, map[string]*outboxEntry{
+			"b": {Put: map[string]string{"k": "1"}, Delete: map[string]bool{}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := newOutbox("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, op := range tt.ops {
+				o.enqueue(op.id, op.put, op.del)
+			}
+			if !reflect.DeepEqual(o.entries, tt.want) {
+				t.Fatalf("entries = %v, want %v", o.entries, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxPrune(t *testing.T) {
+	o, err := newOutbox("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.enqueue("running", map[string]string{"a": "1"}, nil)
+	o.enqueue("stopped", map[string]string{"b": "1"}, []string{"c"})
+	o.enqueue("gone", map[string]string{"d": "1"}, nil)
+	o.enqueue(TraefikOutboxPrefix+"billing-dev", map[string]string{"e": "1"}, nil)
+
+	o.prune(func(id string) bool {
+		return id != "running"
+	})
+	want := map[string]*outboxEntry{
+		"running":                           {Put: map[string]string{"a": "1"}, Delete: map[string]bool{}},
+		"stopped":                           {Put: map[string]string{}, Delete: map[string]bool{"c": true}},
+		TraefikOutboxPrefix + "billing-dev": {Put: map[string]string{"e": "1"}, Delete: map[string]bool{}},
+	}
+	if !reflect.DeepEqual(o.entries, want) {
+		t.Fatalf("entries = %v, want %v", o.entries, want)
+	}
+}
+
+func TestOutboxFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "outbox.json")
+	o, err := newOutbox(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.enqueue("a", map[string]string{"k": "1"}, []string{"j"})
+	if err := o.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := newOutbox(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.entries, o.entries) {
+		t.Fatalf("restored entries = %v, want %v", restored.entries, o.entries)
+	}
+}
+
+func TestFlushOutboxRetry(t *testing.T) {
+	d, kv := newTestDiscovery(t, &config.Config{})
+	kv.setErr(errors.New("etcd unavailable"))
+
+	d.putKeys("a", map[string]string{"k": "1", "j": "1"})
+	e := d.outbox.entries["a"]
+	if e == nil || e.Attempts != 1 || len(e.Put) != 2 {
+		t.Fatalf("entry after a failed flush = %+v, want 2 puts and 1 attempt", e)
+	}
+	if due := d.outbox.due(time.Now()); len(due) != 0 {
+		t.Fatalf("due during backoff = %v, want none", due)
+	}
+	if due := d.outbox.due(time.Now().Add(OutboxMinBackoff)); !reflect.DeepEqual(due, []string{"a"}) {
+		t.Fatalf("due after backoff = %v, want [a]", due)
+	}
+
+	// The delete queued meanwhile collapses with the put, so the retry does
+	// not write back the deleted key.
+	d.deleteKeys("a", []string{"j"})
+	if e.Attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", e.Attempts)
+	}
+
+	kv.setErr(nil)
+	d.flushOutbox("a")
+	if depth := d.outbox.depth(); depth != 0 {
+		t.Fatalf("outbox depth after recovery = %d, want 0", depth)
+	}
+	if got := kv.snapshot(); !reflect.DeepEqual(got, map[string]string{"k": "1"}) {
+		t.Fatalf("keys after recovery = %v, want only k", got)
+	}
+}
+
+func TestFlushOutboxBackoff(t *testing.T) {
+	d, kv := newTestDiscovery(t, &config.Config{})
+	kv.setErr(errors.New("etcd unavailable"))
+
+	d.putKeys("a", map[string]string{"k": "1"})
+	e := d.outbox.entries["a"]
+	for _, want := range []time.Duration{2 * OutboxMinBackoff, 4 * OutboxMinBackoff} {
+		start := time.Now()
+		d.flushOutbox("a")
+		if wait := e.Next.Sub(start); wait < want || wait > want+time.Second {
+			t.Fatalf("backoff after %d attempts = %s, want %s", e.Attempts, wait, want)
+		}
+	}
+
+	e.Attempts = 20
+	start := time.Now()
+	d.flushOutbox("a")
+	if wait := e.Next.Sub(start); wait < OutboxMaxBackoff || wait > OutboxMaxBackoff+time.Second {
+		t.Fatalf("backoff after %d attempts = %s, want %s", e.Attempts, wait, OutboxMaxBackoff)
+	}
+}
@@ -0,0 +1,288 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"go.etcd.io/etcd/clientv3"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	LabelComposeProject = "com.docker.compose.project"
+	PolicyAllow         = "allow"
+	PolicyDeny          = "deny"
+	StatusPolicy        = "policy"
+)
+
+// registrationPolicy is stored as JSON under registry.PolicyKey. A service
+// name listed by any rule may only be claimed by containers matching one of
+// its rules. Names no rule lists follow Default, allow when empty.
+type registrationPolicy struct {
+	Default string        `json:"default,omitempty"`
+	Rules   []*policyRule `json:"rules"`
+}
+
+// policyRule allows the containers matching all of its selectors to register
+// the services and instances. Names, instances and images are path.Match
+// patterns, images are matched without the tag.
+type policyRule struct {
+	Services  []string          `json:"services"`
+	Instances []string          `json:"instances,omitempty"`
+	Images    []string          `json:"images,omitempty"`
+	Digests   []string          `json:"digests,omitempty"`
+	Projects  []string          `json:"projects,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func parsePolicy(value []byte) (*registrationPolicy, error) {
+	p := &registrationPolicy{}
+	if err := json.Unmarshal(value, p); err != nil {
+		return nil, err
+	}
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return nil, fmt.Errorf("unknown default %q", p.Default)
+	}
+	for i, r := range p.Rules {
+		if len(r.Services) == 0 {
+			return nil, fmt.Errorf("rule %d has no services", i)
+		}
+		for _, patterns := range [][]string{r.Services, r.Instances, r.Images} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("rule %d: invalid pattern %q", i, pattern)
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// allowed reports whether the container may register the service instance
+// and the reason when it may not.
+func (p *registrationPolicy) allowed(name, instance string, inspect types.ContainerJSON) (bool, string) {
+	listed := false
+	for _, r := range p.Rules {
+		if !matchAny(r.Services, name) {
+			continue
+		}
+		listed = true
+		if (len(r.Instances) == 0 || matchAny(r.Instances, instance)) && r.matches(inspect) {
+			return true, ""
+		}
+	}
+	if listed {
+		return false, "no rule matches the container"
+	}
+	if p.Default == PolicyDeny {
+		return false, "service is not listed"
+	}
+	return true, ""
+}
+
+func (r *policyRule) matches(inspect types.ContainerJSON) bool {
+	if len(r.Images) > 0 && !matchAny(r.Images, imageRepository(inspect.Config.Image)) {
+		return false
+	}
+	if len(r.Digests) > 0 && !containsString(r.Digests, inspect.Image) && !containsString(r.Digests, imageDigest(inspect.Config.Image)) {
+		return false
+	}
+	if len(r.Projects) > 0 && !containsString(r.Projects, inspect.Config.Labels[LabelComposeProject]) {
+		return false
+	}
+	for k, v := range r.Labels {
+		if inspect.Config.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// imageRepository strips the tag and digest of an image reference.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i != -1 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func imageDigest(image string) string {
+	if i := strings.Index(image, "@"); i != -1 {
+		return image[i+1:]
+	}
+	return ""
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s && s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPolicy validates the name and instance labels and evaluates the
+// registration policy for the container. Denied registrations are logged,
+// counted and remembered until the container is removed, so a policy change
+// can register them.
+func (d *Discovery) checkPolicy(name, instance string, inspect types.ContainerJSON) bool {
+	d.mu.RLock()
+	p := d.policy
+	d.mu.RUnlock()
+
+	ok, reason := true, ""
+	switch {
+	case !registry.ValidName(name) || !registry.ValidName(instance):
+		ok, reason = false, "invalid service name or instance"
+	case d.cfg.Instances != "" && !matchAny(strings.Split(d.cfg.Instances, ","), instance):
+		ok, reason = false, "instance is not served by this agent"
+	case p != nil:
+		ok, reason = p.allowed(name, instance, inspect)
+	}
+	d.mu.Lock()
+	if ok {
+		delete(d.denied, inspect.ID)
+	} else {
+		d.denied[inspect.ID] = true
+	}
+	d.mu.Unlock()
+	if !ok {
+		d.log.Warnf("Registration of %s/%s by container %s (%s) denied: %s",
+			name, instance, registry.ShortID(inspect.ID), inspect.Config.Image, reason)
+		metricRegistrationsDenied.WithLabelValues(name, instance).Inc()
+	}
+	return ok
+}
+
+// loadPolicy reads the policy at startup, so no container is registered
+// before it is known. A missing key disables the policy.
+func (d *Discovery) loadPolicy() (int64, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Get(ctx, registry.PolicyKey)
+	if err != nil {
+		return 0, fmt.Errorf("registration policy read error: %v", err)
+	}
+	if len(resp.Kvs) > 0 {
+		p, err := parsePolicy(resp.Kvs[0].Value)
+		if err != nil {
+			return 0, fmt.Errorf("registration policy %s: %v", registry.PolicyKey, err)
+		}
+		d.mu.Lock()
+		d.policy = p
+		d.mu.Unlock()
+	}
+	return resp.Header.Revision, nil
+}
+
+// watchPolicy applies changes of the policy and re-evaluates the tracked
+// containers against it. An invalid policy is logged and the previous one
+// stays in effect.
+func (d *Discovery) watchPolicy(rev int64) {
+	for d.ctx.Err() == nil {
+		wch := d.etcdClient.Watch(d.ctx, registry.PolicyKey, clientv3.WithRev(rev+1))
+		for wresp := range wch {
+			if wresp.Err() != nil {
+				d.log.Errorf("Registration policy watch error: %v", wresp.Err())
+				break
+			}
+			rev = wresp.Header.Revision
+			for _, ev := range wresp.Events {
+				var p *registrationPolicy
+				if len(ev.Kv.Value) > 0 {
+					var err error
+					if p, err = parsePolicy(ev.Kv.Value); err != nil {
+						d.log.Errorf("Registration policy %s: %v", registry.PolicyKey, err)
+						continue
+					}
+				}
+				d.mu.Lock()
+				d.policy = p
+				d.mu.Unlock()
+				d.log.Infof("Registration policy updated")
+				d.reevaluatePolicy()
+			}
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(DockerReconnectDelay):
+		}
+	}
+}
+
+func (d *Discovery) clearDenied(id string) {
+	d.mu.Lock()
+	delete(d.denied, id)
+	d.mu.Unlock()
+}
+
+func (d *Discovery) reevaluatePolicy() {
+	for _, n := range d.nodes {
+		containers, err := n.client.ContainerList(d.ctx, types.ContainerListOptions{
+			Filters: filters.NewArgs(filters.Arg("label", LabelServiceName)),
+		})
+		if err != nil {
+			d.log.Errorf("Container list error on %s: %v", n.Name, err)
+			continue
+		}
+		for _, c := range containers {
+			if c.State == "running" {
+				d.setContainerNode(c.ID, n)
+				d.dispatch(events.Message{ID: c.ID, Status: StatusPolicy})
+			}
+		}
+	}
+}
+
+// policyChanged deregisters a tracked container the policy no longer allows
+// and registers a running one it denied before and now allows. Containers
+// that were not registered for other reasons, such as flap damping or the
+// conflict policy, are left alone.
+func (d *Discovery) policyChanged(id string) {
+	d.mu.RLock()
+	_, tracked := d.containers[id]
+	denied := d.denied[id]
+	d.mu.RUnlock()
+	if !tracked && (!denied || d.isDamped(id)) {
+		return
+	}
+
+	inspect, err := d.inspect(id)
+	if err != nil {
+		d.log.Errorf("Inspect error: %v", err)
+		return
+	}
+	if inspect.State == nil || !inspect.State.Running || inspect.State.Paused {
+		return
+	}
+
+	name, instance := inspect.Config.Labels[LabelServiceName], inspect.Config.Labels[LabelServiceInstance]
+	allowed := d.checkPolicy(name, instance, inspect)
+	switch {
+	case tracked && !allowed:
+		d.serviceStop(events.Message{ID: id})
+	case !tracked && allowed:
+		d.serviceStart(events.Message{ID: id})
+	}
+}
@@ -0,0 +1,186 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"testing"
+)
+
+func testContainer(image, digest string, labels map[string]string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{Image: digest},
+		Config:            &container.Config{Image: image, Labels: labels},
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"billing", "billing"},
+		{"billing:1.2", "billing"},
+		{"registry.example.com/team/billing:1.2", "registry.example.com/team/billing"},
+		{"registry.example.com:5000/team/billing", "registry.example.com:5000/team/billing"},
+		{"registry.example.com:5000/team/billing:1.2", "registry.example.com:5000/team/billing"},
+		{"billing@sha256:abc", "billing"},
+		{"billing:1.2@sha256:abc", "billing"},
+		{"registry.example.com:5000/billing:1.2@sha256:abc", "registry.example.com:5000/billing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := imageRepository(tt.image); got != tt.want {
+				t.Fatalf("imageRepository(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		ok     bool
+	}{
+		{"empty", `{}`, true},
+		{"deny by default", `{"default": "deny", "rules": [{"services": ["billing"]}]}`, true},
+		{"unknown default", `{"default": "maybe"}`, false},
+		{"rule without services", `{"rules": [{"images": ["billing"]}]}`, false},
+		{"invalid service pattern", `{"rules": [{"services": ["[billing"]}]}`, false},
+		{"invalid image pattern", `{"rules": [{"services": ["billing"], "images": ["[x"]}]}`, false},
+		{"invalid json", `{"rules": [`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parsePolicy([]byte(tt.policy))
+			if (err == nil) != tt.ok {
+				t.Fatalf("parsePolicy() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	policy, err := parsePolicy([]byte(`{
+		"rules": [
+			{"services": ["billing"], "images": ["registry.example.com/billing"]},
+			{"services": ["billing"], "instances": ["dev-*"], "projects": ["sandbox"]},
+			{"services": ["payments-*"], "digests": ["sha256:good"]},
+			{"services": ["auth"], "labels": {"team": "identity"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := parsePolicy([]byte(`{"default": "deny", "rules": [{"services": ["billing"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		policy    *registrationPolicy
+		service   string
+		instance  string
+		container types.ContainerJSON
+		allowed   bool
+	}{
+		{"image matches", policy, "billing", "prod",
+			testContainer("registry.example.com/billing:1.2", "", nil), true},
+		{"image matches with digest", policy, "billing", "prod",
+			testContainer("registry.example.com/billing@sha256:abc", "", nil), true},
+		{"other image", policy, "billing", "prod",
+			testContainer("evil.example.com/billing:1.2", "", nil), false},
+		{"project and instance match", policy, "billing", "dev-42",
+			testContainer("billing:dev", "", map[string]string{LabelComposeProject: "sandbox"}), true},
+		{"project matches other instance", policy, "billing", "prod",
+			testContainer("billing:dev", "", map[string]string{LabelComposeProject: "sandbox"}), false},
+		{"instance matches other project", policy, "billing", "dev-42",
+			testContainer("billing:dev", "", map[string]string{LabelComposeProject: "other"}), false},
+		{"digest of image id", policy, "payments-eu", "prod",
+			testContainer("payments:1", "sha256:good", nil), true},
+		{"digest of reference", policy, "payments-us", "prod",
+			testContainer("payments@sha256:good", "sha256:other", nil), true},
+		{"wrong digest", policy, "payments-eu", "prod",
+			testContainer("payments:1", "sha256:bad", nil), false},
+		{"label matches", policy, "auth", "prod",
+			testContainer("auth:1", "", map[string]string{"team": "identity"}), true},
+		{"label differs", policy, "auth", "prod",
+			testContainer("auth:1", "", map[string]string{"team": "billing"}), false},
+		{"label missing", policy, "auth", "prod",
+			testContainer("auth:1", "", nil), false},
+		{"unlisted service allowed", policy, "search", "prod",
+			testContainer("search:1", "", nil), true},
+		{"unlisted service denied", deny, "search", "prod",
+			testContainer("search:1", "", nil), false},
+		{"listed service with deny default", deny, "billing", "prod",
+			testContainer("billing:1", "", nil), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, reason := tt.policy.allowed(tt.service, tt.instance, tt.container)
+			if allowed != tt.allowed {
+				t.Fatalf("allowed(%s, %s) = %v (%s), want %v", tt.service, tt.instance, allowed, reason, tt.allowed)
+			}
+			if !allowed && reason == "" {
+				t.Fatal("denied without a reason")
+			}
+		})
+	}
+}
+
+func TestPolicyChanged(t *testing.T) {
+	deny, err := parsePolicy([]byte(`{"default": "deny", "rules": [{"services": ["billing"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := testContainerID(1)
+	key := registry.EndpointKey("svc-0", "test", registry.ShortID(id))
+
+	tests := []struct {
+		name       string
+		denied     bool
+		tracked    bool
+		damped     bool
+		policy     *registrationPolicy
+		registered bool
+		deniedNow  bool
+	}{
+		{"denied container now allowed", true, false, false, nil, true, false},
+		{"denied container still denied", true, false, false, deny, false, true},
+		{"damped container stays held", true, false, true, nil, false, true},
+		{"container never denied", false, false, false, nil, false, false},
+		{"tracked container now denied", false, true, false, deny, false, true},
+		{"tracked container still allowed", false, true, false, nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, kv := newTestDiscovery(t, &config.Config{})
+			n := newTestNode(t, fakeDocker(0, 1))
+			d.nodes = []*dockerNode{n}
+			d.setContainerNode(id, n)
+			if tt.tracked {
+				d.serviceStart(events.Message{ID: id, Status: "start"})
+			}
+			d.denied[id] = tt.denied
+			if tt.damped {
+				d.flaps[id] = &flapState{damped: true}
+			}
+			d.policy = tt.policy
+
+			d.policyChanged(id)
+			if _, ok := kv.value(key); ok != tt.registered {
+				t.Fatalf("registered = %v, want %v", ok, tt.registered)
+			}
+			if tracked := d.isTracked(id); tracked != tt.registered {
+				t.Fatalf("tracked = %v, want %v", tracked, tt.registered)
+			}
+			if denied := d.denied[id]; denied != tt.deniedNow {
+				t.Fatalf("denied = %v, want %v", denied, tt.deniedNow)
+			}
+		})
+	}
+}
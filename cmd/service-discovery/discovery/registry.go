@@ -0,0 +1,39 @@
+package discovery
+
+import (
+	"context"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"time"
+)
+
+// registryServices returns the services of the whole registry, registered by
+// any agent, as opposed to the containers tracked by this one.
+func (d *Discovery) registryServices() ([]*client.Service, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	return client.New(d.etcdClient, 0).List(ctx)
+}
+
+// watchRegistry notifies the subscribers of changes made to the registry by
+// any agent, so the views built from it follow the other hosts too. It runs
+// only when a view needs it.
+func (d *Discovery) watchRegistry() {
+	for d.ctx.Err() == nil {
+		for wresp := range d.etcdClient.Watch(d.ctx, registry.ServicesPrefix, clientv3.WithPrefix()) {
+			if err := wresp.Err(); err != nil {
+				d.log.Errorf("Registry watch error: %v", err)
+				break
+			}
+			d.registryChanged()
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(DockerReconnectDelay):
+		}
+		d.registryChanged()
+	}
+}
@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/configs"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types"
+	"go.etcd.io/etcd/clientv3"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	LabelConfigPrefix = "discovery.config."
+	LabelConfigFile   = "discovery.service.config.file"
+	LabelConfigForce  = "discovery.service.config.force"
+	LabelConfigSchema = "discovery.service.config.schema"
+	ConfigFileMaxSize = 1 << 20
+)
+
+// seedConfig writes the default config of the container under
+// /configs/<service>/<instance>/. Values come from the config file in the
+// container and the discovery.config.<key> labels, labels taking precedence.
+// Existing keys are kept unless the force label is set. With a schema, values
+// violating it are not seeded and the resulting config is validated.
+func (d *Discovery) seedConfig(inspect types.ContainerJSON, name, instance string) {
+	schema := d.publishSchema(inspect, name, instance)
+
+	values := make(map[string]string)
+	if path := inspect.Config.Labels[LabelConfigFile]; path != "" {
+		data, err := d.readContainerFile(inspect.ID, path)
+		if err != nil {
+			d.log.Errorf("Config file %s of %s error: %v", path, name, err)
+		} else if values, err = configs.Parse(data); err != nil {
+			d.log.Errorf("Config file %s of %s error: %v", path, name, err)
+			values = make(map[string]string)
+		}
+	}
+	for k, v := range inspect.Config.Labels {
+		if strings.HasPrefix(k, LabelConfigPrefix) {
+			values[strings.TrimPrefix(k, LabelConfigPrefix)] = v
+		}
+	}
+	force := inspect.Config.Labels[LabelConfigForce] == "true"
+	seeded := 0
+	for k, v := range values {
+		if !registry.ValidName(k) {
+			d.log.Errorf("Invalid config key %q of %s/%s", k, name, instance)
+			continue
+		}
+		if schema != nil {
+			if err := schema.ValidateValue(k, v); err != nil {
+				d.log.Errorf("Config value %s of %s/%s not seeded: %v", k, name, instance, err)
+				metricConfigViolations.WithLabelValues(name, instance).Inc()
+				continue
+			}
+		}
+		ok, err := d.seedKey(registry.ConfigKey(name, instance, k), v, force)
+		if err != nil {
+			d.log.Errorf("Config seed of %s error: %v", registry.ConfigKey(name, instance, k), err)
+			continue
+		}
+		if ok {
+			seeded++
+		}
+	}
+
+	if seeded > 0 {
+		d.log.Infof("Seeded %d config keys of %s/%s", seeded, name, instance)
+		metricConfigSeeded.WithLabelValues(name, instance).Add(float64(seeded))
+	}
+
+	if schema != nil {
+		d.validateConfig(schema, name, instance)
+	}
+}
+
+// publishSchema stores the config schema of the container, given inline or as
+// a file path by the schema label, so sdctl validate can check the config.
+func (d *Discovery) publishSchema(inspect types.ContainerJSON, name, instance string) *configs.Schema {
+	label := strings.TrimSpace(inspect.Config.Labels[LabelConfigSchema])
+	if label == "" {
+		return nil
+	}
+
+	data := []byte(label)
+	if !strings.HasPrefix(label, "{") {
+		var err error
+		if data, err = d.readContainerFile(inspect.ID, label); err != nil {
+			d.log.Errorf("Config schema %s of %s error: %v", label, name, err)
+			return nil
+		}
+	}
+	schema, err := configs.ParseSchema(data)
+	if err != nil {
+		d.log.Errorf("Config schema of %s/%s error: %v", name, instance, err)
+		return nil
+	}
+
+	if err := d.etcdPut(registry.SchemaKey(name, instance), string(data)); err != nil {
+		d.log.Errorf("Error writing to ETCD, %v", err)
+	}
+	return schema
+}
+
+// validateConfig checks the stored config of the service instance and reports
+// the violations.
+func (d *Discovery) validateConfig(schema *configs.Schema, name, instance string) {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	values, err := client.New(d.etcdClient, 0).Config(ctx, name, instance)
+	if err != nil {
+		d.log.Errorf("Config of %s/%s read error: %v", name, instance, err)
+		return
+	}
+
+	for _, v := range schema.Validate(values) {
+		d.log.Warnf("Config of %s/%s violates its schema: %v", name, instance, v)
+		metricConfigViolations.WithLabelValues(name, instance).Inc()
+	}
+}
+
+// watchConfigs validates the config of a service instance with a stored
+// schema whenever its config or schema changes, so edits made with etcdctl
+// or a rollback are checked without waiting for a container to register.
+func (d *Discovery) watchConfigs(ctx context.Context) error {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	configsCh := d.etcdClient.Watch(wctx, registry.ConfigsPrefix, clientv3.WithPrefix())
+	schemasCh := d.etcdClient.Watch(wctx, registry.SchemasPrefix, clientv3.WithPrefix())
+
+	for {
+		var wresp clientv3.WatchResponse
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case wresp, ok = <-configsCh:
+		case wresp, ok = <-schemasCh:
+		}
+		if !ok {
+			return ctx.Err()
+		}
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+
+		changed := make(map[configRef]bool)
+		for _, ev := range wresp.Events {
+			if name, instance, _, ok := registry.ParseConfigKey(string(ev.Kv.Key)); ok {
+				changed[configRef{name, instance}] = true
+			} else if name, instance, ok := registry.ParseSchemaKey(string(ev.Kv.Key)); ok {
+				changed[configRef{name, instance}] = true
+			}
+		}
+		for ref := range changed {
+			if err := d.validateStoredConfig(ctx, ref.name, ref.instance); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// validateStoredConfig validates the config of the service instance against
+// its stored schema, if there is one.
+func (d *Discovery) validateStoredConfig(ctx context.Context, name, instance string) error {
+	tctx, cancel := context.WithTimeout(ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	resp, err := d.etcdClient.Get(tctx, registry.SchemaKey(name, instance))
+	cancel()
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	schema, err := configs.ParseSchema(resp.Kvs[0].Value)
+	if err != nil {
+		d.log.Errorf("Config schema of %s/%s error: %v", name, instance, err)
+		return nil
+	}
+	d.validateConfig(schema, name, instance)
+	return nil
+}
+
+// seedKey writes the value when the key does not exist, or always with force,
+// and reports whether it was written.
+func (d *Discovery) seedKey(key, value string, force bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		metricETCDDuration.WithLabelValues("put").Observe(time.Since(start).Seconds())
+	}()
+
+	if force {
+		_, err := d.etcdClient.Put(ctx, key, value)
+		if err != nil {
+			metricETCDErrors.WithLabelValues("put").Inc()
+		}
+		return err == nil, err
+	}
+
+	resp, err := d.etcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).
+		Commit()
+	if err != nil {
+		metricETCDErrors.WithLabelValues("put").Inc()
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// readContainerFile reads a file from the image or a volume of the container.
+func (d *Discovery) readContainerFile(id, path string) ([]byte, error) {
+	n := d.containerNode(id)
+	if n == nil {
+		return nil, fmt.Errorf("no Docker node known for container %s", id)
+	}
+
+	rc, _, err := n.client.CopyFromContainer(d.ctx, id, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is not a file", path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		if h.Size > ConfigFileMaxSize {
+			return nil, fmt.Errorf("%s is larger than %d bytes", path, ConfigFileMaxSize)
+		}
+		return ioutil.ReadAll(tr)
+	}
+}
@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"encoding/json"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types"
+	"strconv"
+	"strings"
+)
+
+const (
+	LabelDNSPort     = "discovery.dns.port"
+	LabelDNSPriority = "discovery.dns.priority"
+	LabelDNSWeight   = "discovery.dns.weight"
+	LabelDNSTTL      = "discovery.dns.ttl"
+)
+
+type skyDNSRecord struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
+}
+
+// skyDNSKey returns the CoreDNS etcd plugin path of the container record,
+// i.e. <id>.<name>.<instance>.<domain> in reversed form under the prefix.
+func (d *Discovery) skyDNSKey(serviceName, serviceInstance, containerID string) string {
+	parts := strings.Split(strings.Trim(d.cfg.SkyDNSDomain, "."), ".")
+	path := make([]string, 0, len(parts)+4)
+	path = append(path, strings.TrimRight(d.cfg.SkyDNSPrefix, "/"))
+	for i := len(parts) - 1; i >= 0; i-- {
+		path = append(path, parts[i])
+	}
+	path = append(path, serviceInstance, serviceName, registry.ShortID(containerID))
+
+	return strings.Join(path, "/")
+}
+
+func (d *Discovery) skyDNSValue(inspect types.ContainerJSON, containerIP string) (string, error) {
+	labels := inspect.Config.Labels
+	record := skyDNSRecord{
+		Host:     containerIP,
+		Port:     labelInt(labels, LabelDNSPort, labelInt(labels, LabelServicePortsGrpc, 0)),
+		Priority: labelInt(labels, LabelDNSPriority, 10),
+		Weight:   labelInt(labels, LabelDNSWeight, 100),
+		TTL:      labelInt(labels, LabelDNSTTL, 0),
+	}
+
+	value, err := json.Marshal(record)
+	return string(value), err
+}
+
+func labelInt(labels map[string]string, label string, def int) int {
+	v, ok := labels[label]
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return i
+}
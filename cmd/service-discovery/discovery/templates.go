@@ -0,0 +1,161 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type configTemplate struct {
+	Source      string
+	Destination string
+	Command     string
+}
+
+// templateData holds the whole registry, registered by any agent.
+type templateData struct {
+	Services []*client.Service
+}
+
+// Service returns the endpoints of the service that are in rotation.
+func (t templateData) Service(name, instance string) []*registry.Endpoint {
+	res := make([]*registry.Endpoint, 0)
+	for _, s := range t.Services {
+		if s.Name != name || s.Instance != instance {
+			continue
+		}
+		for _, e := range s.Endpoints {
+			if e.Routable() {
+				res = append(res, e)
+			}
+		}
+	}
+	return res
+}
+
+// initTemplates parses the templates setting: a semicolon separated list of
+// source:destination[:command] entries, as in consul-template.
+func (d *Discovery) initTemplates() error {
+	for _, entry := range strings.Split(d.cfg.Templates, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid template definition %q", entry)
+		}
+		t := &configTemplate{
+			Source:      parts[0],
+			Destination: parts[1],
+		}
+		if len(parts) == 3 {
+			t.Command = parts[2]
+		}
+		d.templates = append(d.templates, t)
+	}
+	return nil
+}
+
+func (d *Discovery) renderTemplates() {
+	if len(d.templates) == 0 {
+		return
+	}
+
+	changed := d.subscribe()
+	wait := time.Duration(d.cfg.TemplateWait) * time.Millisecond
+	timer := time.NewTimer(wait)
+	for {
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		case <-changed:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+		case <-timer.C:
+			services, err := d.registryServices()
+			if err != nil {
+				d.log.Errorf("Template registry read error: %v", err)
+				timer.Reset(DockerReconnectDelay)
+				continue
+			}
+			data := templateData{Services: services}
+			for _, t := range d.templates {
+				if err := d.renderTemplate(t, data); err != nil {
+					d.log.Errorf("Template %s error: %v", t.Source, err)
+				}
+			}
+		}
+	}
+}
+
+func (d *Discovery) renderTemplate(t *configTemplate, data templateData) error {
+	tmpl, err := template.New(filepath.Base(t.Source)).ParseFiles(t.Source)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	current, err := ioutil.ReadFile(t.Destination)
+	if err == nil && bytes.Equal(current, buf.Bytes()) {
+		return nil
+	}
+
+	if err := writeFileAtomic(t.Destination, buf.Bytes()); err != nil {
+		return err
+	}
+	d.log.Infof("Template %s rendered to %s", t.Source, t.Destination)
+
+	if t.Command == "" {
+		return nil
+	}
+	out, err := exec.CommandContext(d.ctx, "sh", "-c", t.Command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload command %q: %v: %s", t.Command, err, out)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
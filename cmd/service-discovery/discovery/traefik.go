@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"strings"
+	"time"
+)
+
+const (
+	LabelHTTPRule         = "discovery.http.rule"
+	LabelHTTPEntrypoints  = "discovery.http.entrypoints"
+	LabelHTTPPort         = "discovery.http.port"
+	LabelHTTPScheme       = "discovery.http.scheme"
+	TraefikServersPattern = "%s/http/services/%s/loadbalancer/servers/"
+	TraefikRouterPattern  = "%s/http/routers/%s/%s"
+	TraefikOutboxPrefix   = "traefik/"
+)
+
+// traefikServerKey holds the URL of one replica. Servers are keyed by the
+// short container ID, so agents on different hosts registering the same
+// service do not overwrite each other.
+func (d *Discovery) traefikServerKey(serviceName, serviceInstance, id string) string {
+	prefix := strings.TrimRight(d.cfg.TraefikPrefix, "/")
+	return fmt.Sprintf(TraefikServersPattern, prefix, serviceName+"-"+serviceInstance) + registry.ShortID(id) + "/url"
+}
+
+// traefikSync writes the Traefik KV provider keys of the tracked replicas of
+// the service and removes the keys the agent wrote that are no longer
+// needed, such as servers of replicas that stopped or are not routable and
+// entrypoints dropped from the labels. Keys written by hand or by other
+// agents are left alone. The router keys are shared by the agents serving
+// the service and go with the last server.
+func (d *Discovery) traefikSync(serviceName, serviceInstance string) {
+	if d.cfg.TraefikPrefix == "" {
+		return
+	}
+
+	d.traefikMu.Lock()
+	defer d.traefikMu.Unlock()
+
+	prefix := strings.TrimRight(d.cfg.TraefikPrefix, "/")
+	name := serviceName + "-" + serviceInstance
+
+	owned := make(map[string]bool)
+	for _, k := range d.traefikKeys[name] {
+		owned[k] = true
+	}
+
+	etcdKv := make(map[string]string)
+	var labels map[string]string
+	for _, c := range d.replicas(serviceName, serviceInstance) {
+		port, ok := c.Labels[LabelHTTPPort]
+		if !ok {
+			continue
+		}
+		// The server of a tracked replica is the agent's own, also when it
+		// was written before a restart.
+		key := d.traefikServerKey(serviceName, serviceInstance, c.ID)
+		owned[key] = true
+		if !c.routable() {
+			continue
+		}
+		scheme := c.Labels[LabelHTTPScheme]
+		if scheme == "" {
+			scheme = "http"
+		}
+		etcdKv[key] = fmt.Sprintf("%s://%s:%s", scheme, c.Host, port)
+		if labels == nil {
+			labels = c.Labels
+		}
+	}
+
+	routers := fmt.Sprintf(TraefikRouterPattern, prefix, name, "")
+	if labels != nil && labels[LabelHTTPRule] != "" {
+		etcdKv[routers+"rule"] = labels[LabelHTTPRule]
+		etcdKv[routers+"service"] = name
+		if labels[LabelHTTPEntrypoints] != "" {
+			for i, ep := range strings.Split(labels[LabelHTTPEntrypoints], ",") {
+				etcdKv[fmt.Sprintf("%sentrypoints/%d", routers, i)] = strings.TrimSpace(ep)
+			}
+		}
+	}
+
+	stale := make([]string, 0)
+	held := make([]string, 0)
+	for k := range owned {
+		if _, ok := etcdKv[k]; ok {
+			continue
+		}
+		if _, ok := etcdKv[routers+"rule"]; !ok && strings.HasPrefix(k, routers) {
+			held = append(held, k)
+			continue
+		}
+		stale = append(stale, k)
+	}
+
+	// Router keys the agent no longer writes are kept while servers of other
+	// agents are left.
+	if len(held) > 0 {
+		left, err := d.traefikServersLeft(name, stale)
+		if err != nil {
+			d.log.Errorf("Traefik servers of %s read error: %v", name, err)
+		}
+		if err == nil && !left {
+			stale = append(stale, held...)
+			held = held[:0]
+		}
+	}
+
+	keys := held
+	for k := range etcdKv {
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		d.traefikKeys[name] = keys
+	} else {
+		delete(d.traefikKeys, name)
+	}
+
+	d.deleteKeys(TraefikOutboxPrefix+name, stale)
+	d.putKeys(TraefikOutboxPrefix+name, etcdKv)
+}
+
+// traefikServersLeft reports whether etcd holds servers of the service other
+// than the stale keys about to be removed.
+func (d *Discovery) traefikServersLeft(name string, stale []string) (bool, error) {
+	prefix := strings.TrimRight(d.cfg.TraefikPrefix, "/")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.ETCDTimeout)*time.Second)
+	defer cancel()
+	resp, err := d.etcdClient.Get(ctx, fmt.Sprintf(TraefikServersPattern, prefix, name),
+		clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return false, err
+	}
+
+	removed := make(map[string]bool, len(stale))
+	for _, k := range stale {
+		removed[k] = true
+	}
+	for _, v := range resp.Kvs {
+		if !removed[string(v.Key)] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"reflect"
+	"testing"
+)
+
+func TestTraefikSync(t *testing.T) {
+	d, kv := newTestDiscovery(t, &config.Config{TraefikPrefix: "/traefik/"})
+	labels := map[string]string{
+		LabelHTTPPort:        "8080",
+		LabelHTTPRule:        "Host(`billing`)",
+		LabelHTTPEntrypoints: "web, websecure",
+	}
+	d.track(&Container{ID: "aaaaaaaaaaaa", Name: "billing", Instance: "dev", Host: "10.0.0.1", Labels: labels})
+	d.track(&Container{ID: "bbbbbbbbbbbb", Name: "billing", Instance: "dev", Host: "10.0.0.2", Labels: labels})
+	d.track(&Container{ID: "cccccccccccc", Name: "billing", Instance: "dev", Host: "10.0.0.3"})
+	d.track(&Container{ID: "dddddddddddd", Name: "billing", Instance: "dev", Host: "10.0.0.4", Labels: labels,
+		State: registry.StateMaintenance})
+
+	// A server kept by hand, one of another agent and one of a replica in
+	// maintenance written before the agent restarted.
+	manual := "/traefik/http/services/billing-dev/loadbalancer/servers/0/url"
+	other := "/traefik/http/services/billing-dev/loadbalancer/servers/eeeeeeeeeeee/url"
+	for k, v := range map[string]string{
+		manual: "http://10.0.0.9:80",
+		other:  "http://10.0.1.1:8080",
+		"/traefik/http/services/billing-dev/loadbalancer/servers/dddddddddddd/url": "http://10.0.0.4:8080",
+	} {
+		if _, err := d.etcdClient.Put(d.ctx, k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d.traefikSync("billing", "dev")
+	want := map[string]string{
+		"/traefik/http/services/billing-dev/loadbalancer/servers/aaaaaaaaaaaa/url": "http://10.0.0.1:8080",
+		"/traefik/http/services/billing-dev/loadbalancer/servers/bbbbbbbbbbbb/url": "http://10.0.0.2:8080",
+		"/traefik/http/routers/billing-dev/rule":                                   "Host(`billing`)",
+		"/traefik/http/routers/billing-dev/service":                                "billing-dev",
+		"/traefik/http/routers/billing-dev/entrypoints/0":                          "web",
+		"/traefik/http/routers/billing-dev/entrypoints/1":                          "websecure",
+		manual: "http://10.0.0.9:80",
+		other:  "http://10.0.1.1:8080",
+	}
+	if got := kv.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys = %v, want %v", got, want)
+	}
+
+	d.untrack("aaaaaaaaaaaa")
+	d.traefikSync("billing", "dev")
+	delete(want, "/traefik/http/services/billing-dev/loadbalancer/servers/aaaaaaaaaaaa/url")
+	if got := kv.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys after a replica stopped = %v, want %v", got, want)
+	}
+
+	// An entrypoint dropped from the labels is removed.
+	d.untrack("bbbbbbbbbbbb")
+	d.track(&Container{ID: "bbbbbbbbbbbb", Name: "billing", Instance: "dev", Host: "10.0.0.2", Labels: map[string]string{
+		LabelHTTPPort:        "8080",
+		LabelHTTPRule:        "Host(`billing`)",
+		LabelHTTPEntrypoints: "websecure",
+	}})
+	d.traefikSync("billing", "dev")
+	want["/traefik/http/routers/billing-dev/entrypoints/0"] = "websecure"
+	delete(want, "/traefik/http/routers/billing-dev/entrypoints/1")
+	if got := kv.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys after an entrypoint was dropped = %v, want %v", got, want)
+	}
+
+	// The router stays while other servers are left.
+	d.untrack("bbbbbbbbbbbb")
+	d.traefikSync("billing", "dev")
+	delete(want, "/traefik/http/services/billing-dev/loadbalancer/servers/bbbbbbbbbbbb/url")
+	if got := kv.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys after the last local replica stopped = %v, want %v", got, want)
+	}
+
+	for _, k := range []string{other, manual} {
+		if _, err := d.etcdClient.Delete(d.ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.traefikSync("billing", "dev")
+	if got := kv.snapshot(); len(got) != 0 {
+		t.Fatalf("keys after the last server stopped = %v, want none", got)
+	}
+}
@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"github.com/docker/docker/api/types/events"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+const (
+	StatusDrained = "drained"
+)
+
+// startWorkers starts the event workers. Events are sharded by container ID,
+// so events of one container are applied in order while different
+// containers are processed in parallel.
+func (d *Discovery) startWorkers() {
+	workers := d.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queueSize := d.cfg.WorkerQueue
+	if queueSize < 1 {
+		queueSize = 1
+	}
+
+	d.queues = make([]chan events.Message, workers)
+	for i := range d.queues {
+		d.queues[i] = make(chan events.Message, queueSize)
+		d.workers.Add(1)
+		go d.worker(i, d.queues[i])
+	}
+}
+
+func (d *Discovery) worker(n int, queue chan events.Message) {
+	defer d.workers.Done()
+	label := strconv.Itoa(n)
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case msg := <-queue:
+			metricQueueLength.WithLabelValues(label).Set(float64(len(queue)))
+			d.handleEvent(msg)
+		}
+	}
+}
+
+// dispatch queues the event on the worker of the container. A full queue
+// blocks the caller, which stops reading the Docker event stream.
+func (d *Discovery) dispatch(msg events.Message) {
+	h := fnv.New32a()
+	h.Write([]byte(msg.ID))
+	n := int(h.Sum32() % uint32(len(d.queues)))
+	queue := d.queues[n]
+
+	select {
+	case queue <- msg:
+	default:
+		metricQueueBlocked.Inc()
+		start := time.Now()
+		select {
+		case queue <- msg:
+		case <-d.ctx.Done():
+			return
+		}
+		metricQueueBlockedDuration.Observe(time.Since(start).Seconds())
+	}
+	metricQueueLength.WithLabelValues(strconv.Itoa(n)).Set(float64(len(queue)))
+}
+
+func (d *Discovery) handleEvent(msg events.Message) {
+	if d.damp(msg) {
+		return
+	}
+
+	switch {
+	case msg.Status == "start" || msg.Status == "unpause":
+		d.serviceStart(msg)
+	case msg.Status == "die" || msg.Status == "pause":
+		d.serviceStop(msg)
+	case msg.Status == "stop" || (msg.Status == "kill" && drainSignals[msg.Actor.Attributes["signal"]]):
+		d.serviceDrain(msg)
+	case msg.Status == StatusDrained:
+		d.drainExpired(msg.ID)
+	case msg.Status == StatusFlapStable:
+		d.flapStable(msg.ID)
+	case msg.Status == StatusPolicy:
+		d.policyChanged(msg.ID)
+	case msg.Status == StatusHealth:
+		d.setHealth(msg.ID, msg.Actor.Attributes["health"])
+	case msg.Status == StatusMaintenance:
+		d.setState(msg.ID, msg.Actor.Attributes["state"])
+	case msg.Status == StatusRotation:
+		d.retryRotation(msg.ID)
+	case msg.Status == "destroy":
+		d.forgetContainerNode(msg.ID)
+		d.clearDenied(msg.ID)
+	}
+}
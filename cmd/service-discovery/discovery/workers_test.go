@@ -0,0 +1,222 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDocker answers container inspect requests for any container ID with a
+// running container of service "svc-<n>" where n is derived from the ID.
+func fakeDocker(latency time.Duration, services int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 || parts[1] != "containers" || parts[3] != "json" {
+			http.NotFound(w, r)
+			return
+		}
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+
+		id := parts[2]
+		var n int
+		fmt.Sscanf(id[:8], "%08x", &n)
+		_ = json.NewEncoder(w).Encode(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:    id,
+				State: &types.ContainerState{Status: "running", Running: true},
+			},
+			Config: &container.Config{
+				Labels: map[string]string{
+					LabelServiceName:     fmt.Sprintf("svc-%d", n%services),
+					LabelServiceInstance: "test",
+					LabelServiceNetwork:  "backend",
+				},
+			},
+			NetworkSettings: &types.NetworkSettings{
+				Networks: map[string]*network.EndpointSettings{
+					"backend": {IPAddress: fmt.Sprintf("10.0.%d.%d", n/250%250, n%250+1)},
+				},
+			},
+		})
+	})
+}
+
+func testContainerID(n int) string {
+	return fmt.Sprintf("%08x%056x", n, 0)
+}
+
+// newTestNode returns a Docker node served by handler.
+func newTestNode(tb testing.TB, handler http.Handler) *dockerNode {
+	srv := httptest.NewServer(handler)
+	tb.Cleanup(srv.Close)
+
+	dc, err := client.NewClientWithOpts(
+		client.WithHost("tcp://"+srv.Listener.Addr().String()),
+		client.WithHTTPClient(srv.Client()),
+		client.WithVersion("1.40"),
+	)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &dockerNode{Name: "test", client: dc}
+}
+
+// newWorkerDiscovery returns an agent with running workers, inspecting
+// containers on a fake Docker daemon that answers after latency.
+func newWorkerDiscovery(tb testing.TB, workers int, latency time.Duration, services int) (*Discovery, *fakeKV) {
+	d, kv := newTestDiscovery(tb, &config.Config{Workers: workers, WorkerQueue: 128})
+	d.nodes = []*dockerNode{newTestNode(tb, fakeDocker(latency, services))}
+	d.startWorkers()
+	return d, kv
+}
+
+// endpointOps counts the mutations applied to endpoint records.
+func (kv *fakeKV) endpointOps() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	n := 0
+	for k, ops := range kv.ops {
+		if strings.Contains(k, "/endpoints/") {
+			n += len(ops)
+		}
+	}
+	return n
+}
+
+func waitFor(tb testing.TB, cond func() bool) {
+	deadline := time.Now().Add(30 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatal("timed out waiting for events to be applied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	const (
+		containers = 64
+		rounds     = 5
+	)
+	d, kv := newWorkerDiscovery(t, 8, time.Millisecond, 4)
+
+	ids := make([]string, containers)
+	for i := range ids {
+		ids[i] = testContainerID(i)
+		d.setContainerNode(ids[i], d.nodes[0])
+	}
+
+	// Interleave start and die events across containers the way a busy node
+	// reports them; each container ends up started.
+	for r := 0; r < rounds; r++ {
+		status := "start"
+		if r%2 == 1 {
+			status = "die"
+		}
+		for _, id := range ids {
+			d.dispatch(events.Message{ID: id, Status: status})
+		}
+	}
+
+	want := make([]string, rounds)
+	for r := range want {
+		want[r] = "put"
+		if r%2 == 1 {
+			want[r] = "delete"
+		}
+	}
+	waitFor(t, func() bool {
+		return kv.endpointOps() >= containers*rounds
+	})
+
+	for i, id := range ids {
+		key := registry.EndpointKey(fmt.Sprintf("svc-%d", i%4), "test", registry.ShortID(id))
+		if got := kv.history(key); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: mutations = %v, want %v", key, got, want)
+		}
+		d.mu.RLock()
+		_, ok := d.containers[id]
+		d.mu.RUnlock()
+		if !ok {
+			t.Errorf("%s: container is not tracked after its final start", id)
+		}
+	}
+}
+
+func TestStopWaitsForWorkers(t *testing.T) {
+	d, kv := newTestDiscovery(t, &config.Config{Workers: 1, WorkerQueue: 1, ShutdownPolicy: ShutdownDeregister})
+	d.nodes = []*dockerNode{newTestNode(t, fakeDocker(0, 1))}
+	d.leaderDone = make(chan struct{})
+	close(d.leaderDone)
+	d.startWorkers()
+
+	// Hold the registration of a container in flight while the agent stops.
+	writing, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	kv.setPutHook(func(key string) {
+		once.Do(func() {
+			close(writing)
+			<-release
+		})
+	})
+	id := testContainerID(1)
+	d.setContainerNode(id, d.nodes[0])
+	d.dispatch(events.Message{ID: id, Status: "start"})
+	<-writing
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("agent stopped while a worker was registering a container")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	key := registry.EndpointKey("svc-0", "test", registry.ShortID(id))
+	if _, ok := kv.value(key); ok {
+		t.Fatalf("%s is left after the agent deregistered its containers", key)
+	}
+}
+
+func BenchmarkDispatchBurst(b *testing.B) {
+	const burst = 256
+	for _, workers := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			d, kv := newWorkerDiscovery(b, workers, time.Millisecond, 16)
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < burst; j++ {
+					id := testContainerID(i*burst + j)
+					d.setContainerNode(id, d.nodes[0])
+					d.dispatch(events.Message{ID: id, Status: "start"})
+				}
+				waitFor(b, func() bool {
+					return kv.endpointOps() >= (i+1)*burst
+				})
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N*burst)/time.Since(start).Seconds(), "events/s")
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package discovery
+
+import (
+	"github.com/IT-Kungfu/service-discovery/pkg/client"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoveryservice "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	XDSConnectTimeout = 5 * time.Second
+)
+
+// xdsNodeHash makes every Envoy node share the same snapshot.
+type xdsNodeHash struct{}
+
+func (xdsNodeHash) ID(*core.Node) string {
+	return ""
+}
+
+func (d *Discovery) startXDS() error {
+	if d.cfg.XDSAddr == "" {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", d.cfg.XDSAddr)
+	if err != nil {
+		return err
+	}
+
+	d.xdsCache = cache.NewSnapshotCache(false, xdsNodeHash{}, d.log)
+	srv := server.NewServer(d.ctx, d.xdsCache, nil)
+
+	grpcServer := grpc.NewServer()
+	discoveryservice.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, srv)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, srv)
+
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			d.log.Errorf("xDS server error: %v", err)
+		}
+	}()
+	go func() {
+		<-d.ctx.Done()
+		grpcServer.GracefulStop()
+	}()
+	go d.updateXDS()
+
+	d.log.Infof("xDS server listening on %s", d.cfg.XDSAddr)
+	return nil
+}
+
+// updateXDS pushes a snapshot of the whole registry after every change. When
+// the registry cannot be read the previous snapshot stays in place.
+func (d *Discovery) updateXDS() {
+	changed := d.subscribe()
+	var version int64
+	for {
+		services, err := d.registryServices()
+		if err != nil {
+			d.log.Errorf("xDS registry read error: %v", err)
+			select {
+			case <-d.ctx.Done():
+				return
+			case <-time.After(DockerReconnectDelay):
+			}
+			continue
+		}
+
+		version++
+		snapshot := xdsSnapshot(strconv.FormatInt(version, 10), services)
+		if err := d.xdsCache.SetSnapshot("", snapshot); err != nil {
+			d.log.Errorf("xDS snapshot error: %v", err)
+		}
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+func xdsSnapshot(version string, services []*client.Service) cache.Snapshot {
+	clusters := make([]types.Resource, 0, len(services))
+	assignments := make([]types.Resource, 0, len(services))
+
+	for _, s := range services {
+		name := s.Name + "-" + s.Instance
+
+		lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(s.Endpoints))
+		for _, e := range s.Endpoints {
+			port, err := strconv.Atoi(e.Ports[registry.PortGrpc])
+			if err != nil {
+				continue
+			}
+			lbEndpoints = append(lbEndpoints, &endpoint.LbEndpoint{
+				HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+					Endpoint: &endpoint.Endpoint{
+						Address: &core.Address{
+							Address: &core.Address_SocketAddress{
+								SocketAddress: &core.SocketAddress{
+									Address: e.Host,
+									PortSpecifier: &core.SocketAddress_PortValue{
+										PortValue: uint32(port),
+									},
+								},
+							},
+						},
+						Hostname: e.ID,
+					},
+				},
+				HealthStatus: xdsHealth(e),
+			})
+		}
+
+		clusters = append(clusters, &cluster.Cluster{
+			Name:                 name,
+			ConnectTimeout:       ptypes.DurationProto(XDSConnectTimeout),
+			ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+			LbPolicy:             cluster.Cluster_ROUND_ROBIN,
+			EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+				EdsConfig: &core.ConfigSource{
+					ResourceApiVersion:    core.ApiVersion_V3,
+					ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+				},
+			},
+		})
+		assignments = append(assignments, &endpoint.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*endpoint.LocalityLbEndpoints{{
+				Locality:    &core.Locality{Zone: s.Instance},
+				LbEndpoints: lbEndpoints,
+			}},
+		})
+	}
+
+	return cache.NewSnapshotWithResources(version, cache.SnapshotResources{
+		Endpoints: assignments,
+		Clusters:  clusters,
+	})
+}
+
+func xdsHealth(e *registry.Endpoint) core.HealthStatus {
+	if e.State != "" {
+		return core.HealthStatus_DRAINING
+	}
+	switch e.Health {
+	case registry.HealthPassing:
+		return core.HealthStatus_HEALTHY
+	case registry.HealthCritical:
+		return core.HealthStatus_UNHEALTHY
+	}
+	return core.HealthStatus_UNKNOWN
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"github.com/IT-Kungfu/etcdconfig"
 	"github.com/IT-Kungfu/logger"
 	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/config"
 	"github.com/IT-Kungfu/service-discovery/cmd/service-discovery/discovery"
@@ -13,14 +12,14 @@ import (
 )
 
 var (
-	etcd = &etcdconfig.ETCDConfig{}
+	etcd = &config.ETCDConfig{}
 	cfg  = &config.Config{}
 	log  *logger.Logger
 )
 
 func init() {
 	var err error
-	etcd, err = etcdconfig.GetConfig(cfg)
+	etcd, err = config.GetConfig(cfg)
 	if err != nil {
 		panic(err)
 	}
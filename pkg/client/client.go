@@ -0,0 +1,403 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/configs"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheTTL = 5 * time.Second
+)
+
+type Service struct {
+	Name      string               `json:"name"`
+	Instance  string               `json:"instance"`
+	Endpoints []*registry.Endpoint `json:"endpoints"`
+}
+
+type Event struct {
+	Name      string
+	Instance  string
+	Endpoints []*registry.Endpoint
+	Err       error
+}
+
+type cacheEntry struct {
+	endpoints  []*registry.Endpoint
+	fetched    time.Time
+	refreshing bool
+}
+
+// Client reads the service registry. Lookup results are cached for the TTL
+// and served stale while a background refresh is running.
+type Client struct {
+	etcd  *clientv3.Client
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+func New(etcd *clientv3.Client, ttl time.Duration) *Client {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Client{
+		etcd:  etcd,
+		ttl:   ttl,
+		cache: make(map[string]*cacheEntry),
+	}
+}
+
+func (c *Client) Lookup(ctx context.Context, name, instance string) ([]*registry.Endpoint, error) {
+	key := name + "/" + instance
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	if ok && time.Since(entry.fetched) < c.ttl {
+		c.mu.Unlock()
+		return entry.endpoints, nil
+	}
+	if ok {
+		if !entry.refreshing {
+			entry.refreshing = true
+			go c.refresh(name, instance)
+		}
+		c.mu.Unlock()
+		return entry.endpoints, nil
+	}
+	c.mu.Unlock()
+
+	endpoints, err := c.fetch(ctx, name, instance)
+	if err != nil {
+		return nil, err
+	}
+	c.store(name, instance, endpoints)
+	return endpoints, nil
+}
+
+func (c *Client) List(ctx context.Context) ([]*Service, error) {
+	resp, err := c.etcd.Get(ctx, registry.ServicesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[[2]string]map[string]string)
+	for _, v := range resp.Kvs {
+		name, instance, ok := registry.ParseKey(string(v.Key))
+		if !ok {
+			continue
+		}
+		key := [2]string{name, instance}
+		if byName[key] == nil {
+			byName[key] = make(map[string]string)
+		}
+		byName[key][string(v.Key)] = string(v.Value)
+	}
+
+	res := make([]*Service, 0, len(byName))
+	for key, kv := range byName {
+		res = append(res, &Service{
+			Name:      key[0],
+			Instance:  key[1],
+			Endpoints: registry.Decode(key[0], key[1], kv),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name != res[j].Name {
+			return res[i].Name < res[j].Name
+		}
+		return res[i].Instance < res[j].Instance
+	})
+	return res, nil
+}
+
+// Watch delivers the endpoints of the service after every change. An empty
+// name watches all services, an empty instance all instances of the name.
+// The channel is closed when the context is done.
+func (c *Client) Watch(ctx context.Context, name, instance string) <-chan Event {
+	prefix := registry.ServicesPrefix
+	if name != "" {
+		prefix += name + "/"
+		if instance != "" {
+			prefix += instance + "/"
+		}
+	}
+
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		wch := c.etcd.Watch(ctx, prefix, clientv3.WithPrefix())
+		for resp := range wch {
+			if err := resp.Err(); err != nil {
+				if !c.send(ctx, ch, Event{Err: err}) {
+					return
+				}
+				continue
+			}
+
+			changed := make(map[[2]string]bool)
+			for _, ev := range resp.Events {
+				if n, i, ok := registry.ParseKey(string(ev.Kv.Key)); ok {
+					changed[[2]string{n, i}] = true
+				}
+			}
+			for s := range changed {
+				endpoints, err := c.fetch(ctx, s[0], s[1])
+				if err == nil {
+					c.store(s[0], s[1], endpoints)
+				}
+				if !c.send(ctx, ch, Event{Name: s[0], Instance: s[1], Endpoints: endpoints, Err: err}) {
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (c *Client) send(ctx context.Context, ch chan<- Event, ev Event) bool {
+	select {
+	case ch <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Client) fetch(ctx context.Context, name, instance string) ([]*registry.Endpoint, error) {
+	resp, err := c.etcd.Get(ctx, fmt.Sprintf(registry.ServicePrefixPattern, name, instance), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	kv := make(map[string]string, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		kv[string(v.Key)] = string(v.Value)
+	}
+	return registry.Decode(name, instance, kv), nil
+}
+
+func (c *Client) refresh(name, instance string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ttl)
+	defer cancel()
+
+	endpoints, err := c.fetch(ctx, name, instance)
+	if err != nil {
+		c.mu.Lock()
+		if entry, ok := c.cache[name+"/"+instance]; ok {
+			entry.refreshing = false
+		}
+		c.mu.Unlock()
+		return
+	}
+	c.store(name, instance, endpoints)
+}
+
+func (c *Client) store(name, instance string, endpoints []*registry.Endpoint) {
+	c.mu.Lock()
+	c.cache[name+"/"+instance] = &cacheEntry{
+		endpoints: endpoints,
+		fetched:   time.Now(),
+	}
+	c.mu.Unlock()
+}
+
+// Nodes returns the records of the Docker nodes with a live agent.
+func (c *Client) Nodes(ctx context.Context) ([]*registry.Node, error) {
+	resp, err := c.etcd.Get(ctx, registry.NodesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*registry.Node, 0, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		n, err := registry.ParseNode(v.Value)
+		if err != nil {
+			continue
+		}
+		res = append(res, n)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res, nil
+}
+
+// ValidateConfigs checks the config of every service instance with a stored
+// schema against it. An empty name checks all services, an empty instance all
+// instances of the name.
+func (c *Client) ValidateConfigs(ctx context.Context, name, instance string) ([]*configs.Violation, error) {
+	prefix := registry.SchemasPrefix
+	if name != "" {
+		prefix += name + "/"
+		if instance != "" {
+			prefix = registry.SchemaKey(name, instance)
+		}
+	}
+	schemas, err := c.etcd.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*configs.Violation, 0)
+	for _, v := range schemas.Kvs {
+		n, i, ok := registry.ParseSchemaKey(string(v.Key))
+		if !ok {
+			continue
+		}
+		schema, err := configs.ParseSchema(v.Value)
+		if err != nil {
+			res = append(res, &configs.Violation{Service: n, Instance: i, Key: string(v.Key), Message: "invalid schema: " + err.Error()})
+			continue
+		}
+		values, err := c.Config(ctx, n, i)
+		if err != nil {
+			return nil, err
+		}
+		for _, violation := range schema.Validate(values) {
+			violation.Service, violation.Instance = n, i
+			res = append(res, violation)
+		}
+	}
+	return res, nil
+}
+
+// Config returns the config values of a service instance by key.
+func (c *Client) Config(ctx context.Context, name, instance string) (map[string]string, error) {
+	return c.configAt(ctx, name, instance, 0)
+}
+
+// Register writes a static endpoint record together with the host and ports
+// keys, the same way the agent registers a container.
+func (c *Client) Register(ctx context.Context, name, instance string, e *registry.Endpoint) error {
+	value, err := e.Marshal()
+	if err != nil {
+		return err
+	}
+
+	ops := []clientv3.Op{
+		clientv3.OpPut(registry.EndpointKey(name, instance, e.ID), value),
+		clientv3.OpPut(fmt.Sprintf(registry.HostPattern, name, instance), e.Host),
+	}
+	if e.ExternalHost != "" {
+		ops = append(ops, clientv3.OpPut(fmt.Sprintf(registry.ExternalHostPattern, name, instance), e.ExternalHost))
+	}
+	if p, ok := e.Ports[registry.PortGrpc]; ok {
+		ops = append(ops, clientv3.OpPut(fmt.Sprintf(registry.PortsGrpcPattern, name, instance), p))
+	}
+	if p, ok := e.ExternalPorts[registry.PortGrpc]; ok {
+		ops = append(ops, clientv3.OpPut(fmt.Sprintf(registry.ExternalPortsGrpcPattern, name, instance), p))
+	}
+
+	_, err = c.etcd.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// Deregister removes the endpoint record. The host and ports keys are removed
+// only while they still point to the endpoint.
+func (c *Client) Deregister(ctx context.Context, name, instance, id string) error {
+	key := registry.EndpointKey(name, instance, id)
+	resp, err := c.etcd.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return fmt.Errorf("endpoint %s not found", key)
+	}
+	e, err := registry.ParseEndpoint(resp.Kvs[0].Value)
+	if err != nil {
+		_, err = c.etcd.Delete(ctx, key)
+		return err
+	}
+
+	hostKey := fmt.Sprintf(registry.HostPattern, name, instance)
+	_, err = c.etcd.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(hostKey), "=", e.Host)).
+		Then(
+			clientv3.OpDelete(key),
+			clientv3.OpDelete(hostKey),
+			clientv3.OpDelete(fmt.Sprintf(registry.ExternalHostPattern, name, instance)),
+			clientv3.OpDelete(fmt.Sprintf(registry.PortsGrpcPattern, name, instance)),
+			clientv3.OpDelete(fmt.Sprintf(registry.ExternalPortsGrpcPattern, name, instance)),
+		).
+		Else(clientv3.OpDelete(key)).
+		Commit()
+	return err
+}
+
+// GC removes registry keys no consumer can use: endpoint records that cannot
+// be decoded, ports keys of services without a host key and maintenance keys
+// of endpoints that no longer exist. With dryRun the keys are only returned.
+func (c *Client) GC(ctx context.Context, dryRun bool) ([]string, error) {
+	resp, err := c.etcd.Get(ctx, registry.ServicesPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	kv := make(map[string]string, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		kv[string(v.Key)] = string(v.Value)
+	}
+
+	garbage := make([]string, 0)
+	for k, v := range kv {
+		name, instance, ok := registry.ParseKey(k)
+		if !ok {
+			continue
+		}
+		if strings.HasPrefix(k, fmt.Sprintf(registry.EndpointsPattern, name, instance)) {
+			if _, err := registry.ParseEndpoint([]byte(v)); err != nil {
+				garbage = append(garbage, k)
+			}
+			continue
+		}
+		if _, ok := kv[fmt.Sprintf(registry.HostPattern, name, instance)]; !ok {
+			garbage = append(garbage, k)
+		}
+	}
+
+	maintenance, err := c.etcd.Get(ctx, registry.MaintenancePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range maintenance.Kvs {
+		name, instance, id, ok := registry.ParseMaintenanceKey(string(v.Key))
+		if !ok {
+			continue
+		}
+		if _, ok := kv[registry.EndpointKey(name, instance, id)]; !ok {
+			garbage = append(garbage, string(v.Key))
+		}
+	}
+	sort.Strings(garbage)
+
+	if dryRun {
+		return garbage, nil
+	}
+	for _, k := range garbage {
+		if _, err := c.etcd.Delete(ctx, k); err != nil {
+			return nil, err
+		}
+	}
+	return garbage, nil
+}
+
+// SetState takes the endpoint out of rotation with the maintenance or
+// draining state. An empty state returns it to service.
+func (c *Client) SetState(ctx context.Context, name, instance, id, state string) error {
+	key := registry.MaintenanceKey(name, instance, id)
+	if state == "" {
+		_, err := c.etcd.Delete(ctx, key)
+		return err
+	}
+	if state != registry.StateMaintenance && state != registry.StateDraining {
+		return fmt.Errorf("unknown state %s", state)
+	}
+	_, err := c.etcd.Put(ctx, key, state)
+	return err
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/configs"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"strings"
+	"time"
+)
+
+// History returns the config snapshots of a service instance, oldest first.
+func (c *Client) History(ctx context.Context, name, instance string) ([]*configs.Snapshot, error) {
+	resp, err := c.etcd.Get(ctx, fmt.Sprintf(registry.HistoryPattern, name, instance),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*configs.Snapshot, 0, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		s, err := configs.ParseSnapshot(v.Value)
+		if err != nil {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// Version returns the config of a service instance at the revision: the
+// snapshot taken at it or, when there is none, the state kept by etcd at that
+// revision unless it was compacted.
+func (c *Client) Version(ctx context.Context, name, instance string, revision int64) (*configs.Snapshot, error) {
+	resp, err := c.etcd.Get(ctx, registry.HistoryKey(name, instance, revision))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) > 0 {
+		return configs.ParseSnapshot(resp.Kvs[0].Value)
+	}
+
+	values, err := c.configAt(ctx, name, instance, revision)
+	if err != nil {
+		return nil, fmt.Errorf("revision %d of %s/%s: %v", revision, name, instance, err)
+	}
+	return &configs.Snapshot{Revision: revision, Values: values}, nil
+}
+
+// Snapshot stores the config of a service instance at the revision, 0 for the
+// current one, unless it equals the latest snapshot. Snapshots beyond the
+// limit are removed, oldest first; a limit of 0 keeps all of them. The stored
+// snapshot is returned, nil when the config did not change.
+func (c *Client) Snapshot(ctx context.Context, name, instance string, revision int64, limit int) (*configs.Snapshot, error) {
+	if revision == 0 {
+		resp, err := c.etcd.Get(ctx, fmt.Sprintf(registry.ConfigPrefixPattern, name, instance),
+			clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, err
+		}
+		revision = resp.Header.Revision
+	}
+	values, err := c.configAt(ctx, name, instance, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := c.History(ctx, name, instance)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(history); n > 0 && (history[n-1].Revision >= revision || configs.Equal(history[n-1].Values, values)) {
+		return nil, nil
+	}
+	if len(history) == 0 && len(values) == 0 {
+		return nil, nil
+	}
+
+	s := &configs.Snapshot{Revision: revision, Time: time.Now().UTC(), Values: values}
+	value, err := s.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.etcd.Put(ctx, registry.HistoryKey(name, instance, revision), value); err != nil {
+		return nil, err
+	}
+
+	history = append(history, s)
+	for limit > 0 && len(history) > limit {
+		if _, err := c.etcd.Delete(ctx, registry.HistoryKey(name, instance, history[0].Revision)); err != nil {
+			return s, err
+		}
+		history = history[1:]
+	}
+	return s, nil
+}
+
+// Restore replaces the config of a service instance with its version at the
+// revision in one transaction: keys missing from the version are deleted and
+// changed ones are written back. The changes made are returned.
+func (c *Client) Restore(ctx context.Context, name, instance string, revision int64) ([]*configs.Change, error) {
+	version, err := c.Version(ctx, name, instance, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf(registry.ConfigPrefixPattern, name, instance)
+	resp, err := c.etcd.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]string, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		current[strings.TrimPrefix(string(v.Key), prefix)] = string(v.Value)
+	}
+
+	changes := configs.Diff(current, version.Values)
+	if len(changes) == 0 {
+		return changes, nil
+	}
+	ops := make([]clientv3.Op, 0, len(changes))
+	for _, ch := range changes {
+		if ch.Op == configs.ChangeRemoved {
+			ops = append(ops, clientv3.OpDelete(prefix+ch.Key))
+		} else {
+			ops = append(ops, clientv3.OpPut(prefix+ch.Key, ch.New))
+		}
+	}
+
+	// A key written after the read fails the comparison, so a concurrent
+	// change is not silently overwritten.
+	txn, err := c.etcd.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(prefix).WithPrefix(), "<", resp.Header.Revision+1)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !txn.Succeeded {
+		return nil, fmt.Errorf("config of %s/%s changed during the restore, try again", name, instance)
+	}
+	return changes, nil
+}
+
+// configAt returns the config of a service instance at the revision, 0 for
+// the current one.
+func (c *Client) configAt(ctx context.Context, name, instance string, revision int64) (map[string]string, error) {
+	prefix := fmt.Sprintf(registry.ConfigPrefixPattern, name, instance)
+	resp, err := c.etcd.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		values[strings.TrimPrefix(string(v.Key), prefix)] = string(v.Value)
+	}
+	return values, nil
+}
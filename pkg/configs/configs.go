@@ -0,0 +1,56 @@
+package configs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse reads default config values from a JSON object or from key=value
+// lines, where empty lines and lines starting with # are skipped.
+func Parse(data []byte) (map[string]string, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("{")) {
+		return parseJSON(data)
+	}
+
+	res := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("line %d: expected key=value", n)
+		}
+		res[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return res, scanner.Err()
+}
+
+func parseJSON(data []byte) (map[string]string, error) {
+	values := make(map[string]interface{})
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string, len(values))
+	for k, v := range values {
+		switch v := v.(type) {
+		case string:
+			res[k] = v
+		case float64:
+			res[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			res[k] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("value of %s is not a string, number or bool", k)
+		}
+	}
+	return res, nil
+}
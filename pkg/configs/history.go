@@ -0,0 +1,68 @@
+package configs
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeUpdated = "updated"
+)
+
+// Snapshot is the config of a service instance at an etcd revision.
+type Snapshot struct {
+	Revision int64             `json:"revision"`
+	Time     time.Time         `json:"time"`
+	Values   map[string]string `json:"values"`
+}
+
+type Change struct {
+	Key string `json:"key"`
+	Op  string `json:"op"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+func ParseSnapshot(value []byte) (*Snapshot, error) {
+	s := &Snapshot{}
+	if err := json.Unmarshal(value, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Snapshot) Marshal() (string, error) {
+	value, err := json.Marshal(s)
+	return string(value), err
+}
+
+// Diff returns the changes from the old to the new values sorted by key.
+func Diff(old, new map[string]string) []*Change {
+	res := make([]*Change, 0)
+	for k, v := range new {
+		o, ok := old[k]
+		switch {
+		case !ok:
+			res = append(res, &Change{Key: k, Op: ChangeAdded, New: v})
+		case o != v:
+			res = append(res, &Change{Key: k, Op: ChangeUpdated, Old: o, New: v})
+		}
+	}
+	for k, o := range old {
+		if _, ok := new[k]; !ok {
+			res = append(res, &Change{Key: k, Op: ChangeRemoved, Old: o})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// Equal reports whether both configs hold the same values.
+func Equal(a, b map[string]string) bool {
+	return len(Diff(a, b)) == 0
+}
@@ -0,0 +1,46 @@
+package configs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  map[string]string
+		new  map[string]string
+		want []Change
+	}{
+		{"equal", map[string]string{"a": "1"}, map[string]string{"a": "1"}, []Change{}},
+		{"both empty", nil, map[string]string{}, []Change{}},
+		{"added", nil, map[string]string{"a": "1"}, []Change{{Key: "a", Op: ChangeAdded, New: "1"}}},
+		{"removed", map[string]string{"a": "1"}, nil, []Change{{Key: "a", Op: ChangeRemoved, Old: "1"}}},
+		{"updated", map[string]string{"a": "1"}, map[string]string{"a": "2"},
+			[]Change{{Key: "a", Op: ChangeUpdated, Old: "1", New: "2"}}},
+		{"updated to empty", map[string]string{"a": "1"}, map[string]string{"a": ""},
+			[]Change{{Key: "a", Op: ChangeUpdated, Old: "1"}}},
+		{"sorted by key",
+			map[string]string{"c": "1", "b": "1", "keep": "x"},
+			map[string]string{"a": "1", "b": "2", "keep": "x"},
+			[]Change{
+				{Key: "a", Op: ChangeAdded, New: "1"},
+				{Key: "b", Op: ChangeUpdated, Old: "1", New: "2"},
+				{Key: "c", Op: ChangeRemoved, Old: "1"},
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]Change, 0)
+			for _, c := range Diff(tt.old, tt.new) {
+				got = append(got, *c)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Diff() = %v, want %v", got, tt.want)
+			}
+			if Equal(tt.old, tt.new) != (len(tt.want) == 0) {
+				t.Fatalf("Equal() = %v with %d changes", Equal(tt.old, tt.new), len(tt.want))
+			}
+		})
+	}
+}
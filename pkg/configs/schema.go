@@ -0,0 +1,148 @@
+package configs
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeNumber  = "number"
+	TypeBoolean = "boolean"
+)
+
+// Schema is the subset of JSON Schema describing a flat config object, as
+// read by etcdconfig: every property is one key holding a string value that
+// must parse as its type.
+type Schema struct {
+	Properties           map[string]*Property `json:"properties"`
+	Required             []string             `json:"required,omitempty"`
+	AdditionalProperties *bool                `json:"additionalProperties,omitempty"`
+}
+
+type Property struct {
+	Type    string        `json:"type,omitempty"`
+	Enum    []interface{} `json:"enum,omitempty"`
+	Minimum *float64      `json:"minimum,omitempty"`
+	Maximum *float64      `json:"maximum,omitempty"`
+	Pattern string        `json:"pattern,omitempty"`
+	pattern *regexp.Regexp
+}
+
+type Violation struct {
+	Service  string `json:"service,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Key      string `json:"key"`
+	Message  string `json:"message"`
+}
+
+func (v *Violation) Error() string {
+	return v.Key + ": " + v.Message
+}
+
+func ParseSchema(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	for k, p := range s.Properties {
+		if p == nil {
+			return nil, fmt.Errorf("property %s: not an object", k)
+		}
+		switch p.Type {
+		case "", TypeString, TypeInteger, TypeNumber, TypeBoolean:
+		default:
+			return nil, fmt.Errorf("property %s: unsupported type %q", k, p.Type)
+		}
+		if p.Pattern != "" {
+			re, err := regexp.Compile(p.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %v", k, err)
+			}
+			p.pattern = re
+		}
+	}
+	return s, nil
+}
+
+// Validate checks the config values and returns the violations sorted by key.
+func (s *Schema) Validate(values map[string]string) []*Violation {
+	res := make([]*Violation, 0)
+	for _, k := range s.Required {
+		if _, ok := values[k]; !ok {
+			res = append(res, &Violation{Key: k, Message: "required key is missing"})
+		}
+	}
+	for k, v := range values {
+		p, ok := s.Properties[k]
+		if !ok {
+			if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				res = append(res, &Violation{Key: k, Message: "key is not defined in the schema"})
+			}
+			continue
+		}
+		if err := p.validate(v); err != nil {
+			res = append(res, &Violation{Key: k, Message: err.Error()})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// ValidateValue checks one value, e.g. before it is seeded.
+func (s *Schema) ValidateValue(key, value string) error {
+	p, ok := s.Properties[key]
+	if !ok {
+		if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+			return fmt.Errorf("key is not defined in the schema")
+		}
+		return nil
+	}
+	return p.validate(value)
+}
+
+func (p *Property) validate(value string) error {
+	var number float64
+	var err error
+	switch p.Type {
+	case TypeInteger:
+		var i int64
+		if i, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		number = float64(i)
+	case TypeNumber:
+		if number, err = strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+	case TypeBoolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+	}
+
+	if (p.Type == TypeInteger || p.Type == TypeNumber) && p.Minimum != nil && number < *p.Minimum {
+		return fmt.Errorf("%s is less than %s", value, strconv.FormatFloat(*p.Minimum, 'f', -1, 64))
+	}
+	if (p.Type == TypeInteger || p.Type == TypeNumber) && p.Maximum != nil && number > *p.Maximum {
+		return fmt.Errorf("%s is greater than %s", value, strconv.FormatFloat(*p.Maximum, 'f', -1, 64))
+	}
+	if p.pattern != nil && !p.pattern.MatchString(value) {
+		return fmt.Errorf("%q does not match %s", value, p.Pattern)
+	}
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if fmt.Sprint(e) == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %v", value, p.Enum)
+	}
+	return nil
+}
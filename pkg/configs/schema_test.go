@@ -0,0 +1,142 @@
+package configs
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+	"properties": {
+		"log_level": {"type": "string", "enum": ["debug", "info", "warn", "error"]},
+		"workers": {"type": "integer", "minimum": 1, "maximum": 64},
+		"ratio": {"type": "number", "minimum": 0, "maximum": 1},
+		"enabled": {"type": "boolean"},
+		"name": {"pattern": "^[a-z]+$"},
+		"retries": {"type": "integer", "enum": [1, 3, 5]}
+	},
+	"required": ["log_level"]
+}`
+
+func TestParseSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		ok     bool
+	}{
+		{"valid", testSchema, true},
+		{"empty", `{}`, true},
+		{"untyped property", `{"properties": {"a": {}}}`, true},
+		{"null property", `{"properties": {"a": null}}`, false},
+		{"unsupported type", `{"properties": {"a": {"type": "object"}}}`, false},
+		{"invalid pattern", `{"properties": {"a": {"pattern": "("}}}`, false},
+		{"invalid json", `{"properties":`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSchema([]byte(tt.schema))
+			if (err == nil) != tt.ok {
+				t.Fatalf("ParseSchema() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPropertyValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{"log_level", "info", true},
+		{"log_level", "trace", false},
+		{"workers", "8", true},
+		{"workers", "1", true},
+		{"workers", "64", true},
+		{"workers", "0", false},
+		{"workers", "65", false},
+		{"workers", "8.5", false},
+		{"workers", "eight", false},
+		{"ratio", "0.25", true},
+		{"ratio", "1", true},
+		{"ratio", "-0.1", false},
+		{"ratio", "1.5", false},
+		{"ratio", "half", false},
+		{"enabled", "true", true},
+		{"enabled", "false", true},
+		{"enabled", "yes", false},
+		{"enabled", "1", false},
+		{"name", "billing", true},
+		{"name", "Billing", false},
+		{"retries", "3", true},
+		{"retries", "2", false},
+		{"unknown", "anything", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			err := schema.ValidateValue(tt.key, tt.value)
+			if (err == nil) != tt.ok {
+				t.Fatalf("ValidateValue(%q, %q) error = %v, want ok %v", tt.key, tt.value, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	closed, err := ParseSchema([]byte(`{
+		"properties": {"log_level": {"enum": ["info", "debug"]}, "workers": {"type": "integer"}},
+		"required": ["log_level", "workers"],
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		schema *Schema
+		values map[string]string
+		keys   []string
+	}{
+		{"valid", open, map[string]string{"log_level": "info", "workers": "4"}, []string{}},
+		{"additional allowed", open, map[string]string{"log_level": "info", "extra": "x"}, []string{}},
+		{"missing required", open, map[string]string{"workers": "4"}, []string{"log_level"}},
+		{"invalid values sorted", open, map[string]string{"log_level": "info", "workers": "0", "enabled": "no"},
+			[]string{"enabled", "workers"}},
+		{"additional denied", closed, map[string]string{"log_level": "info", "workers": "2", "extra": "x"},
+			[]string{"extra"}},
+		{"empty config", closed, map[string]string{}, []string{"log_level", "workers"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := make([]string, 0)
+			for _, v := range tt.schema.Validate(tt.values) {
+				keys = append(keys, v.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Fatalf("Validate() violations = %v, want %v", keys, tt.keys)
+			}
+		})
+	}
+}
+
+func TestValidateValueAdditionalProperties(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"properties": {"a": {}}, "additionalProperties": false}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := schema.ValidateValue("a", "x"); err != nil {
+		t.Fatalf("ValidateValue(a) error = %v", err)
+	}
+	if err := schema.ValidateValue("b", "x"); err == nil {
+		t.Fatal("ValidateValue(b) accepted a key missing from the schema")
+	}
+}
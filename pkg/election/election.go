@@ -0,0 +1,147 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.etcd.io/etcd/clientv3"
+	"sync"
+)
+
+var ErrNotLeader = errors.New("election: not leader")
+
+// Election elects one leader among the campaigners on a key prefix, using the
+// algorithm of etcd's clientv3/concurrency package: every candidate creates a
+// key under the prefix attached to its session lease, the key with the lowest
+// create revision is the leader and the others wait for the deletion of their
+// predecessor. The concurrency package of the vendored etcd module is built
+// against github.com/coreos/etcd/clientv3 and cannot use this client.
+type Election struct {
+	client *clientv3.Client
+	prefix string
+	ttl    int64
+	mu     sync.Mutex
+	lease  clientv3.LeaseID
+	key    string
+	rev    int64
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+func New(client *clientv3.Client, prefix string, ttl int64) *Election {
+	return &Election{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+	}
+}
+
+// Campaign blocks until the candidate is elected or the context is done. The
+// value is published as the leader value.
+func (e *Election) Campaign(ctx context.Context, value string) error {
+	grant, err := e.client.Grant(ctx, e.ttl)
+	if err != nil {
+		return err
+	}
+
+	kaCtx, kaCancel := context.WithCancel(context.Background())
+	keepAlive, err := e.client.KeepAlive(kaCtx, grant.ID)
+	if err != nil {
+		kaCancel()
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		for range keepAlive {
+		}
+		close(done)
+	}()
+
+	key := fmt.Sprintf("%s%x", e.prefix, grant.ID)
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value, clientv3.WithLease(grant.ID))).
+		Commit()
+	if err != nil {
+		kaCancel()
+		return err
+	}
+
+	e.mu.Lock()
+	e.lease, e.key, e.rev, e.done, e.cancel = grant.ID, key, resp.Header.Revision, done, kaCancel
+	e.mu.Unlock()
+
+	if err := e.waitPredecessors(ctx); err != nil {
+		e.Resign(context.Background())
+		return err
+	}
+	return nil
+}
+
+// waitPredecessors waits until no key with a lower create revision is left.
+func (e *Election) waitPredecessors(ctx context.Context) error {
+	for {
+		opts := append(clientv3.WithLastCreate(), clientv3.WithMaxCreateRev(e.rev-1))
+		resp, err := e.client.Get(ctx, e.prefix, append(opts, clientv3.WithPrefix())...)
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return nil
+		}
+
+		predecessor := string(resp.Kvs[0].Key)
+		wctx, cancel := context.WithCancel(ctx)
+		wch := e.client.Watch(wctx, predecessor, clientv3.WithRev(resp.Header.Revision+1))
+		deleted := false
+		for wresp := range wch {
+			for _, ev := range wresp.Events {
+				if ev.Type == clientv3.EventTypeDelete {
+					deleted = true
+				}
+			}
+			if deleted || wresp.Err() != nil {
+				break
+			}
+		}
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Done is closed when the session lease of the elected candidate is lost.
+func (e *Election) Done() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.done
+}
+
+// Resign gives up the leadership, so another candidate is elected at once
+// instead of after the lease TTL.
+func (e *Election) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	lease, cancel := e.lease, e.cancel
+	e.lease, e.key, e.rev = 0, "", 0
+	e.mu.Unlock()
+
+	if lease == 0 {
+		return ErrNotLeader
+	}
+	cancel()
+	_, err := e.client.Revoke(ctx, lease)
+	return err
+}
+
+// Leader returns the value of the current leader.
+func (e *Election) Leader(ctx context.Context) (string, error) {
+	resp, err := e.client.Get(ctx, e.prefix, append(clientv3.WithFirstCreate(), clientv3.WithPrefix())...)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", nil
+	}
+	return string(resp.Kvs[0].Value), nil
+}
@@ -0,0 +1,68 @@
+package etcdclient
+
+import (
+	"github.com/IT-Kungfu/service-discovery/pkg/etcdclient/namespace"
+	"go.etcd.io/etcd/clientv3"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultETCDAddr    = "localhost:2379"
+	DefaultDialTimeout = 10 * time.Second
+)
+
+// ConfigFromEnv builds the client configuration from ETCD_ADDR,
+// ETCD_USERNAME and ETCD_PASSWORD, the same variables etcdconfig reads, and
+// the TLS variables of TLSConfigFromEnv.
+func ConfigFromEnv() (clientv3.Config, error) {
+	etcdAddr := os.Getenv("ETCD_ADDR")
+	if len(etcdAddr) == 0 {
+		etcdAddr = DefaultETCDAddr
+	}
+
+	etcdConfig := clientv3.Config{
+		Endpoints:   strings.Split(etcdAddr, ","),
+		DialTimeout: DefaultDialTimeout,
+	}
+
+	if os.Getenv("ETCD_USERNAME") != "" && os.Getenv("ETCD_PASSWORD") != "" {
+		etcdConfig.Username = os.Getenv("ETCD_USERNAME")
+		etcdConfig.Password = os.Getenv("ETCD_PASSWORD")
+	}
+
+	tlsConfig, err := TLSConfigFromEnv()
+	if err != nil {
+		return etcdConfig, err
+	}
+	etcdConfig.TLS = tlsConfig
+
+	return etcdConfig, nil
+}
+
+// Namespace returns the key prefix of ETCD_NAMESPACE, e.g. /dev, without the
+// trailing slash, so /services/ becomes /dev/services/.
+func Namespace() string {
+	return strings.TrimRight(os.Getenv("ETCD_NAMESPACE"), "/")
+}
+
+// New connects to etcd. With ETCD_NAMESPACE all reads, writes, watches and
+// leases of the client are confined to the namespace prefix.
+func New() (*clientv3.Client, error) {
+	etcdConfig, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cli, err := clientv3.New(etcdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if ns := Namespace(); ns != "" {
+		cli.KV = namespace.NewKV(cli.KV, ns)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, ns)
+		cli.Lease = namespace.NewLease(cli.Lease, ns)
+	}
+	return cli, nil
+}
@@ -0,0 +1,144 @@
+package etcdclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader keeps the CA bundle and client certificate loaded from files
+// and reloads them when a file changes, so rotated certificates are picked up
+// on the next handshake without restarting.
+type certReloader struct {
+	caFile     string
+	certFile   string
+	keyFile    string
+	serverName string
+	mu         sync.Mutex
+	modTimes   map[string]time.Time
+	pool       *x509.CertPool
+	cert       *tls.Certificate
+}
+
+// TLSConfigFromEnv builds the TLS configuration from ETCD_CACERT, ETCD_CERT,
+// ETCD_KEY and ETCD_SERVER_NAME. It returns nil when none of them is set.
+func TLSConfigFromEnv() (*tls.Config, error) {
+	r := &certReloader{
+		caFile:     os.Getenv("ETCD_CACERT"),
+		certFile:   os.Getenv("ETCD_CERT"),
+		keyFile:    os.Getenv("ETCD_KEY"),
+		serverName: os.Getenv("ETCD_SERVER_NAME"),
+		modTimes:   make(map[string]time.Time),
+	}
+	if r.caFile == "" && r.certFile == "" && r.keyFile == "" && r.serverName == "" {
+		return nil, nil
+	}
+	if (r.certFile == "") != (r.keyFile == "") {
+		return nil, fmt.Errorf("etcd TLS: ETCD_CERT and ETCD_KEY must be set together")
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	// Verification is done in VerifyConnection against the reloaded CA pool,
+	// the standard verification would keep the pool of the first handshake.
+	return &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		ServerName:           r.serverName,
+		InsecureSkipVerify:   true,
+		VerifyConnection:     r.verifyConnection,
+		GetClientCertificate: r.clientCertificate,
+	}, nil
+}
+
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.caFile != "" && r.changed(r.caFile) {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return r.failed(fmt.Errorf("etcd TLS: read CA certificate %s: %v", r.caFile, err), r.caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return r.failed(fmt.Errorf("etcd TLS: no certificates found in %s", r.caFile), r.caFile)
+		}
+		r.pool = pool
+	}
+
+	if r.certFile != "" {
+		certChanged, keyChanged := r.changed(r.certFile), r.changed(r.keyFile)
+		if certChanged || keyChanged {
+			cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+			if err != nil {
+				return r.failed(fmt.Errorf("etcd TLS: load client certificate %s: %v", r.certFile, err), r.certFile, r.keyFile)
+			}
+			r.cert = &cert
+		}
+	}
+	return nil
+}
+
+// changed records the modification time of the file and reports whether it
+// differs from the last load.
+func (r *certReloader) changed(file string) bool {
+	info, err := os.Stat(file)
+	if err != nil {
+		delete(r.modTimes, file)
+		return true
+	}
+	last, ok := r.modTimes[file]
+	r.modTimes[file] = info.ModTime()
+	return !ok || !last.Equal(info.ModTime())
+}
+
+// failed forgets the files so the next handshake retries loading them, a
+// rotation may have replaced the certificate before the key.
+func (r *certReloader) failed(err error, files ...string) error {
+	for _, f := range files {
+		delete(r.modTimes, f)
+	}
+	return err
+}
+
+// clientCertificate and verifyConnection reload changed files before every
+// handshake. A failed reload keeps the material of the last successful load.
+func (r *certReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_ = r.reload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	_ = r.reload()
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("etcd TLS: no server certificate")
+	}
+
+	r.mu.Lock()
+	pool := r.pool
+	r.mu.Unlock()
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	if r.serverName != "" {
+		opts.DNSName = r.serverName
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,283 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ServicesPrefix           = "/services/"
+	ServicePrefixPattern     = "/services/%s/%s/"
+	HostPattern              = "/services/%s/%s/host"
+	ExternalHostPattern      = "/services/%s/%s/host/external"
+	PortsGrpcPattern         = "/services/%s/%s/ports/grpc"
+	ExternalPortsGrpcPattern = "/services/%s/%s/ports/grpc/external"
+	OwnerPattern             = "/services/%s/%s/owner"
+	EndpointsPattern         = "/services/%s/%s/endpoints/"
+	EndpointPattern          = "/services/%s/%s/endpoints/%s"
+	PortGrpc                 = "grpc"
+	ExternalSuffix           = "/external"
+	EnvExternalSuffix        = "_EXTERNAL"
+	HealthPassing            = "passing"
+	HealthCritical           = "critical"
+	StateDraining            = "draining"
+	StateMaintenance         = "maintenance"
+	MaintenancePrefix        = "/maintenance/"
+	MaintenancePattern       = "/maintenance/%s/%s/%s"
+	PolicyKey                = "/policy/registration"
+	NodesPrefix              = "/nodes/"
+	NodePattern              = "/nodes/%s"
+	LeaderPrefix             = "/leader/"
+	ConfigsPrefix            = "/configs/"
+	ConfigPrefixPattern      = "/configs/%s/%s/"
+	HistoryPrefix            = "/history/configs/"
+	HistoryPattern           = "/history/configs/%s/%s/"
+	SchemasPrefix            = "/schemas/"
+	SchemaPattern            = "/schemas/%s/%s"
+)
+
+// Endpoint is the record of one replica stored under EndpointPattern.
+type Endpoint struct {
+	ID            string            `json:"id"`
+	Node          string            `json:"node,omitempty"`
+	Host          string            `json:"host"`
+	ExternalHost  string            `json:"external_host,omitempty"`
+	Ports         map[string]string `json:"ports,omitempty"`
+	ExternalPorts map[string]string `json:"external_ports,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Health        string            `json:"health,omitempty"`
+	State         string            `json:"state,omitempty"`
+}
+
+// Node is the record of a Docker node watched by an agent, stored under
+// NodePattern with the lease of the agent. Endpoints whose node record is
+// gone belong to a dead node.
+type Node struct {
+	Name          string    `json:"name"`
+	Agent         string    `json:"agent"`
+	IPs           []string  `json:"ips,omitempty"`
+	DockerVersion string    `json:"docker_version,omitempty"`
+	AgentVersion  string    `json:"agent_version"`
+	Started       time.Time `json:"started"`
+}
+
+func ParseNode(value []byte) (*Node, error) {
+	n := &Node{}
+	if err := json.Unmarshal(value, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *Node) Marshal() (string, error) {
+	value, err := json.Marshal(n)
+	return string(value), err
+}
+
+func NodeKey(name string) string {
+	return fmt.Sprintf(NodePattern, name)
+}
+
+// Owner is stored under OwnerPattern and names the node and container that
+// wrote the host and ports keys of the service.
+type Owner struct {
+	Node      string `json:"node"`
+	Container string `json:"container"`
+}
+
+func ParseOwner(value []byte) (*Owner, error) {
+	o := &Owner{}
+	if err := json.Unmarshal(value, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *Owner) Marshal() (string, error) {
+	value, err := json.Marshal(o)
+	return string(value), err
+}
+
+func ParseEndpoint(value []byte) (*Endpoint, error) {
+	e := &Endpoint{}
+	if err := json.Unmarshal(value, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Routable reports whether the endpoint should receive traffic: it is not
+// failing its health check and not taken out of rotation. Endpoints without
+// active health checks are always healthy.
+func (e *Endpoint) Routable() bool {
+	return e.Health != HealthCritical && e.State == ""
+}
+
+func (e *Endpoint) Marshal() (string, error) {
+	value, err := json.Marshal(e)
+	return string(value), err
+}
+
+// Address returns host:port of the named port, using the published host port
+// and the external host when external is set. An empty string is returned
+// when the endpoint does not expose the port.
+func (e *Endpoint) Address(port string, external bool) string {
+	host, p := e.Host, e.Ports[port]
+	if external {
+		host, p = e.ExternalHost, e.ExternalPorts[port]
+		if i := strings.Index(p, ","); i != -1 {
+			p = p[:i]
+		}
+	}
+	if host == "" || p == "" {
+		return ""
+	}
+	return host + ":" + p
+}
+
+// IsExternal reports whether a client of the service should use the external
+// addresses, following the <SERVICE>_EXTERNAL convention of etcdconfig.
+func IsExternal(getenv func(string) string, serviceName string) bool {
+	env := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(serviceName)) + EnvExternalSuffix
+	return getenv(env) == "true"
+}
+
+func EndpointKey(serviceName, serviceInstance, id string) string {
+	return fmt.Sprintf(EndpointPattern, serviceName, serviceInstance, id)
+}
+
+// MaintenanceKey is the control key holding the state of an endpoint taken
+// out of rotation. Deleting it returns the endpoint to service.
+func MaintenanceKey(serviceName, serviceInstance, id string) string {
+	return fmt.Sprintf(MaintenancePattern, serviceName, serviceInstance, id)
+}
+
+func ParseMaintenanceKey(key string) (string, string, string, bool) {
+	if !strings.HasPrefix(key, MaintenancePrefix) {
+		return "", "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, MaintenancePrefix), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// ConfigKey is the key etcdconfig reads for the config field tagged with
+// /configs/<service>/{{INSTANCE}}/<key>.
+func ConfigKey(serviceName, serviceInstance, key string) string {
+	return fmt.Sprintf(ConfigPrefixPattern, serviceName, serviceInstance) + key
+}
+
+// ParseConfigKey returns the service name, instance and config key of a key
+// under ConfigsPrefix.
+func ParseConfigKey(key string) (string, string, string, bool) {
+	if !strings.HasPrefix(key, ConfigsPrefix) {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, ConfigsPrefix), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// HistoryKey holds the snapshot of the config of a service instance taken at
+// the etcd revision. Revisions are zero padded so keys sort by revision.
+func HistoryKey(serviceName, serviceInstance string, revision int64) string {
+	return fmt.Sprintf(HistoryPattern+"%020d", serviceName, serviceInstance, revision)
+}
+
+// SchemaKey holds the JSON Schema of the config of a service instance.
+func SchemaKey(serviceName, serviceInstance string) string {
+	return fmt.Sprintf(SchemaPattern, serviceName, serviceInstance)
+}
+
+func ParseSchemaKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, SchemasPrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(key, SchemasPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// ValidName reports whether a service name or instance is a single key
+// segment, so a label cannot write outside the keys of its service.
+func ValidName(s string) bool {
+	if s == "" || s == "." || s == ".." {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func ShortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// ParseKey returns the service name and instance of a registry key.
+func ParseKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, ServicesPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, ServicesPrefix), "/", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Decode builds the endpoints of a service from its keys. Services registered
+// without endpoint records are decoded from the host and ports keys.
+func Decode(serviceName, serviceInstance string, kv map[string]string) []*Endpoint {
+	prefix := fmt.Sprintf(EndpointsPattern, serviceName, serviceInstance)
+	res := make([]*Endpoint, 0)
+	for k, v := range kv {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		e, err := ParseEndpoint([]byte(v))
+		if err != nil {
+			continue
+		}
+		res = append(res, e)
+	}
+
+	if len(res) == 0 {
+		host, ok := kv[fmt.Sprintf(HostPattern, serviceName, serviceInstance)]
+		if !ok {
+			return res
+		}
+		e := &Endpoint{
+			Host:          host,
+			ExternalHost:  kv[fmt.Sprintf(ExternalHostPattern, serviceName, serviceInstance)],
+			Ports:         make(map[string]string),
+			ExternalPorts: make(map[string]string),
+		}
+		if p, ok := kv[fmt.Sprintf(PortsGrpcPattern, serviceName, serviceInstance)]; ok {
+			e.Ports[PortGrpc] = p
+		}
+		if p, ok := kv[fmt.Sprintf(ExternalPortsGrpcPattern, serviceName, serviceInstance)]; ok {
+			e.ExternalPorts[PortGrpc] = p
+		}
+		res = append(res, e)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	endpoint := func(e *Endpoint) string {
+		value, err := e.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	a := &Endpoint{ID: "aaaaaaaaaaaa", Host: "10.0.0.1", Ports: map[string]string{PortGrpc: "9000"}}
+	b := &Endpoint{ID: "bbbbbbbbbbbb", Host: "10.0.0.2", State: StateMaintenance}
+
+	tests := []struct {
+		name string
+		kv   map[string]string
+		want []*Endpoint
+	}{
+		{"empty", map[string]string{}, []*Endpoint{}},
+		{"records sorted by id", map[string]string{
+			EndpointKey("billing", "dev", b.ID):        endpoint(b),
+			EndpointKey("billing", "dev", a.ID):        endpoint(a),
+			fmt.Sprintf(HostPattern, "billing", "dev"): "10.0.0.9",
+		}, []*Endpoint{a, b}},
+		{"invalid record skipped", map[string]string{
+			EndpointKey("billing", "dev", a.ID):     endpoint(a),
+			EndpointKey("billing", "dev", "broken"): "{",
+		}, []*Endpoint{a}},
+		{"records of other instances ignored", map[string]string{
+			EndpointKey("billing", "prod", a.ID): endpoint(a),
+		}, []*Endpoint{}},
+		{"legacy keys", map[string]string{
+			fmt.Sprintf(HostPattern, "billing", "dev"):              "10.0.0.9",
+			fmt.Sprintf(ExternalHostPattern, "billing", "dev"):      "1.2.3.4",
+			fmt.Sprintf(PortsGrpcPattern, "billing", "dev"):         "9000",
+			fmt.Sprintf(ExternalPortsGrpcPattern, "billing", "dev"): "19000",
+		}, []*Endpoint{{
+			Host:          "10.0.0.9",
+			ExternalHost:  "1.2.3.4",
+			Ports:         map[string]string{PortGrpc: "9000"},
+			ExternalPorts: map[string]string{PortGrpc: "19000"},
+		}}},
+		{"legacy keys without ports", map[string]string{
+			fmt.Sprintf(HostPattern, "billing", "dev"): "10.0.0.9",
+		}, []*Endpoint{{Host: "10.0.0.9", Ports: map[string]string{}, ExternalPorts: map[string]string{}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Decode("billing", "dev", tt.kv); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
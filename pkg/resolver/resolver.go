@@ -0,0 +1,161 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/IT-Kungfu/service-discovery/pkg/registry"
+	"go.etcd.io/etcd/clientv3"
+	"google.golang.org/grpc/resolver"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	Scheme = "discovery"
+)
+
+// Builder resolves discovery:///name/instance targets from the service
+// registry and keeps the ClientConn updated with all replicas.
+type Builder struct {
+	client *clientv3.Client
+	// External forces the external addresses. When nil, the <NAME>_EXTERNAL
+	// environment variable of the target service decides.
+	External *bool
+}
+
+// Register registers the discovery scheme in the gRPC resolver registry.
+func Register(client *clientv3.Client) *Builder {
+	b := NewBuilder(client)
+	resolver.Register(b)
+	return b
+}
+
+func NewBuilder(client *clientv3.Client) *Builder {
+	return &Builder{client: client}
+}
+
+func (b *Builder) Scheme() string {
+	return Scheme
+}
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	parts := strings.Split(strings.Trim(target.Endpoint, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid discovery target %q, expected %s:///name/instance", target.Endpoint, Scheme)
+	}
+
+	external := registry.IsExternal(os.Getenv, parts[0])
+	if b.External != nil {
+		external = *b.External
+	}
+
+	r := &etcdResolver{
+		client:   b.client,
+		cc:       cc,
+		name:     parts[0],
+		instance: parts[1],
+		external: external,
+		resolve:  make(chan struct{}, 1),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	go r.watch()
+
+	return r, nil
+}
+
+type etcdResolver struct {
+	client   *clientv3.Client
+	cc       resolver.ClientConn
+	name     string
+	instance string
+	external bool
+	resolve  chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+func (r *etcdResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolve <- struct{}{}:
+	default:
+	}
+}
+
+func (r *etcdResolver) Close() {
+	r.cancel()
+}
+
+func (r *etcdResolver) watch() {
+	for r.ctx.Err() == nil {
+		rev, err := r.update()
+		if err != nil {
+			r.cc.ReportError(err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-r.resolve:
+			}
+			continue
+		}
+		r.watchChanges(rev)
+	}
+}
+
+// watchChanges updates the addresses on changes after rev until ResolveNow is
+// called or the watch fails. The watch is cancelled before the caller
+// resolves again and opens the next one.
+func (r *etcdResolver) watchChanges(rev int64) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+
+	prefix := fmt.Sprintf(registry.ServicePrefixPattern, r.name, r.instance)
+	wch := r.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.resolve:
+			return
+		case resp, ok := <-wch:
+			if !ok || resp.Err() != nil {
+				return
+			}
+			if _, err := r.update(); err != nil {
+				r.cc.ReportError(err)
+			}
+		}
+	}
+}
+
+func (r *etcdResolver) update() (int64, error) {
+	resp, err := r.client.Get(r.ctx, fmt.Sprintf(registry.ServicePrefixPattern, r.name, r.instance), clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+
+	kv := make(map[string]string, len(resp.Kvs))
+	for _, v := range resp.Kvs {
+		kv[string(v.Key)] = string(v.Value)
+	}
+
+	addrs := make([]string, 0)
+	for _, e := range registry.Decode(r.name, r.instance, kv) {
+		if !e.Routable() {
+			continue
+		}
+		if addr := e.Address(registry.PortGrpc, r.external); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	sort.Strings(addrs)
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	r.cc.UpdateState(state)
+
+	return resp.Header.Revision, nil
+}
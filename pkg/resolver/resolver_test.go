@@ -0,0 +1,90 @@
+package resolver
+
+import (
+	"context"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"go.etcd.io/etcd/clientv3"
+	"google.golang.org/grpc/resolver"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeKV struct {
+	clientv3.KV
+}
+
+func (kv *fakeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: 1}}, nil
+}
+
+// fakeWatcher records the context of every watch.
+type fakeWatcher struct {
+	clientv3.Watcher
+	mu      sync.Mutex
+	watches []context.Context
+}
+
+func (w *fakeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	w.mu.Lock()
+	w.watches = append(w.watches, ctx)
+	w.mu.Unlock()
+	return make(chan clientv3.WatchResponse)
+}
+
+func (w *fakeWatcher) opened() []context.Context {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]context.Context(nil), w.watches...)
+}
+
+type fakeClientConn struct {
+	resolver.ClientConn
+}
+
+func (cc *fakeClientConn) UpdateState(resolver.State) {}
+
+func (cc *fakeClientConn) ReportError(error) {}
+
+func TestResolveNowCancelsWatch(t *testing.T) {
+	w := &fakeWatcher{}
+	b := NewBuilder(&clientv3.Client{KV: &fakeKV{}, Watcher: w})
+	r, err := b.Build(resolver.Target{Endpoint: "billing/dev"}, &fakeClientConn{}, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitWatches := func(n int) []context.Context {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if watches := w.opened(); len(watches) >= n {
+				return watches
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for watch %d", n)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitWatches(1)
+	for i := 2; i <= 4; i++ {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+		watches := waitWatches(i)
+		for j, ctx := range watches[:len(watches)-1] {
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatalf("watch %d is still open after %d resolves", j+1, i-1)
+			}
+		}
+	}
+
+	r.Close()
+	watches := w.opened()
+	select {
+	case <-watches[len(watches)-1].Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch is still open after Close")
+	}
+}